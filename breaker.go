@@ -0,0 +1,74 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"time"
+)
+
+// circuitBreaker skips drains after consecutive failed drains, it is only used under mux by the drain
+type circuitBreaker struct {
+	failures    int
+	cooldown    time.Duration
+	consecutive int
+	open        bool
+	openedAt    time.Time
+}
+
+// SetCircuitBreaker to stop sending for cooldown after failures consecutive failed drains.
+// Logs stay queued while the circuit is open, the next drain after the cooldown probes the listener
+func SetCircuitBreaker(failures int, cooldown time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if failures <= 0 {
+			return fmt.Errorf("invalid circuit breaker failures %d", failures)
+		}
+		if cooldown < 0 {
+			return fmt.Errorf("invalid circuit breaker cooldown %v", cooldown)
+		}
+		l.breaker = &circuitBreaker{failures: failures, cooldown: cooldown}
+		return nil
+	}
+}
+
+// allow reports whether a drain may send, the circuit is half-open once the cooldown elapsed
+func (c *circuitBreaker) allow(now time.Time) bool {
+	if c == nil || !c.open {
+		return true
+	}
+	return now.Sub(c.openedAt) >= c.cooldown
+}
+
+func (c *circuitBreaker) isOpen() bool {
+	return c != nil && c.open
+}
+
+// record the outcome of a drain that sent at least one request
+func (c *circuitBreaker) record(failed bool, now time.Time) {
+	if c == nil {
+		return
+	}
+	if !failed {
+		c.consecutive = 0
+		c.open = false
+		return
+	}
+	c.consecutive++
+	// a failed probe opens the circuit again right away
+	if c.open || c.consecutive >= c.failures {
+		c.open = true
+		c.openedAt = now
+	}
+}
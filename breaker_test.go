@@ -0,0 +1,100 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests, down int32 = 0, 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetCircuitBreaker(2, 200*time.Millisecond),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+
+	l.Drain()
+	l.Drain()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("%d requests before opening", n)
+	}
+	// open
+	l.Drain()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("%d requests while open", n)
+	}
+	if l.QueueCount() != 1 {
+		t.Fatalf("%d logs queued while open", l.QueueCount())
+	}
+
+	// failed probe after the cooldown opens the circuit again
+	time.Sleep(250 * time.Millisecond)
+	l.Drain()
+	l.Drain()
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("%d requests after a failed probe", n)
+	}
+
+	// successful probe closes the circuit
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(250 * time.Millisecond)
+	res := l.DrainWithResult()
+	if res.SentLogs != 1 {
+		t.Fatalf("Unexpected probe result %+v", res)
+	}
+	atomic.StoreInt32(&down, 1)
+	l.Send([]byte("blah"))
+	l.Drain()
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Fatalf("%d requests after closing", n)
+	}
+}
+
+type noRetryPolicy struct{}
+
+func (noRetryPolicy) ShouldRetry(int, int) (bool, time.Duration) {
+	return false, 0
+}
+
+func TestSetCircuitBreaker_Invalid(t *testing.T) {
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetCircuitBreaker(0, time.Second)); err == nil {
+		t.Fatal("expected an error for 0 failures")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetCircuitBreaker(1, -time.Second)); err == nil {
+		t.Fatal("expected an error for a negative cooldown")
+	}
+}
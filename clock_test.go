@@ -0,0 +1,225 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves forward with Advance, Sleep blocks until then
+type fakeClock struct {
+	mux      sync.Mutex
+	now      time.Time
+	sleepers []fakeSleeper
+	sleeps   chan time.Duration
+}
+
+type fakeSleeper struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), sleeps: make(chan time.Duration, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mux.Lock()
+	s := fakeSleeper{until: c.now.Add(d), wake: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+	c.mux.Unlock()
+	c.sleeps <- d
+	<-s.wake
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+	sleeping := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if c.now.Before(s.until) {
+			sleeping = append(sleeping, s)
+			continue
+		}
+		close(s.wake)
+	}
+	c.sleepers = sleeping
+}
+
+// nextSleep waits for a Sleep other than the drain timer's
+func (c *fakeClock) nextSleep(t *testing.T, drainDuration time.Duration) time.Duration {
+	for {
+		select {
+		case d := <-c.sleeps:
+			if d != drainDuration {
+				return d
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no sleep")
+		}
+	}
+}
+
+func TestLogzioSender_BackoffWithFakeClock(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	c := newFakeClock()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+
+	results := make(chan DrainResult, 1)
+	go func() {
+		results <- l.DrainWithResult()
+	}()
+	var waits []time.Duration
+	for i := 0; i < sendRetries-1; i++ {
+		wait := c.nextSleep(t, time.Hour)
+		if n := atomic.LoadInt32(&requests); n != int32(i+1) {
+			t.Fatalf("%d requests before backoff %v", n, wait)
+		}
+		waits = append(waits, wait)
+		c.Advance(wait)
+	}
+	res := <-results
+	if res.Requeued != 1 || atomic.LoadInt32(&requests) != sendRetries {
+		t.Fatalf("Unexpected result %+v after %d requests", res, requests)
+	}
+	if fmt.Sprint(waits) != "[2s 4s 8s]" {
+		t.Fatalf("Unexpected backoff %v", waits)
+	}
+
+	// the drain timer started sleeping before the backoff
+	c.Advance(time.Hour - 14*time.Second - time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != sendRetries {
+		t.Fatalf("%d requests before the drain duration", n)
+	}
+	c.Advance(time.Second)
+	if wait := c.nextSleep(t, time.Hour); wait != 2*time.Second {
+		t.Fatalf("Unexpected backoff %v after the timer drain", wait)
+	}
+	if n := atomic.LoadInt32(&requests); n != sendRetries+1 {
+		t.Fatalf("%d requests after the drain duration", n)
+	}
+}
+
+func TestLogzioSender_AlignedDrain(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	c := newFakeClock()
+	c.Advance(3 * time.Second)
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetAlignedDrain(10*time.Second),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	if wait := c.nextSleep(t, 0); wait != 7*time.Second {
+		t.Fatalf("Expected the first drain on the 10s boundary, waiting %v", wait)
+	}
+	c.Advance(6 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("%d requests before the boundary", n)
+	}
+	c.Advance(time.Second)
+	if wait := c.nextSleep(t, 0); wait != 10*time.Second {
+		t.Fatalf("Unexpected wait %v after the aligned drain", wait)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("%d requests on the boundary", n)
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetAlignedDrain(0)); err == nil {
+		t.Fatal("Expected an error for a zero drain window")
+	}
+}
+
+func TestLogzioSender_Heartbeat(t *testing.T) {
+	c := newFakeClock()
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetHeartbeat(30*time.Second, []byte(`{"type":"heartbeat"}`)),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 1; i <= 3; i++ {
+		if wait := c.nextSleep(t, time.Hour); wait != 30*time.Second {
+			t.Fatalf("Unexpected heartbeat interval %v", wait)
+		}
+		if count := l.QueueCount(); count != uint64(i-1) {
+			t.Fatalf("Unexpected %d queued heartbeats before heartbeat %d", count, i)
+		}
+		c.Advance(30 * time.Second)
+	}
+	c.nextSleep(t, time.Hour)
+	logs := l.PeekQueue(5)
+	if len(logs) != 3 || string(logs[0]) != `{"type":"heartbeat"}` {
+		t.Fatalf("Unexpected heartbeats %q", logs)
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetHeartbeat(0, []byte("beat"))); err == nil {
+		t.Fatal("Expected an error for a zero heartbeat interval")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetHeartbeat(time.Second, nil)); err == nil {
+		t.Fatal("Expected an error for an empty heartbeat")
+	}
+}
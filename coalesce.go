@@ -0,0 +1,216 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/beeker1121/goque"
+)
+
+// writeBuffer coalesces small logs into larger queue items
+type writeBuffer struct {
+	mux  sync.Mutex
+	size int
+	data []byte
+	ends []int // offsets following each buffered log, before its newline
+}
+
+// coalescedItems holds the log ends of the queued items joining several logs, by item id, so the
+// coalesced logs count one by one. The ends of the disk queue items of a previous run are not known
+type coalescedItems struct {
+	mux   sync.Mutex
+	ends  map[uint64][]int
+	extra uint64 // logs beyond the first of each coalesced item
+}
+
+// enqueue adds the item enqueued by enqueue with the logs ending at ends, under the lock so the
+// drain doesn't find the item before its ends
+func (c *coalescedItems) enqueue(ends []int, enqueue func() (*goque.Item, error)) (*goque.Item, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	item, err := enqueue()
+	if err == nil {
+		if c.ends == nil {
+			c.ends = make(map[uint64][]int)
+		}
+		c.ends[item.ID] = ends
+		c.extra += uint64(len(ends) - 1)
+	}
+	return item, err
+}
+
+// get returns the log ends of a queued item, nil for an item holding a single log
+func (c *coalescedItems) get(id uint64) []int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.ends[id]
+}
+
+// remove returns the number of logs of a dequeued item
+func (c *coalescedItems) remove(id uint64) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ends, ok := c.ends[id]
+	if !ok {
+		return 1
+	}
+	delete(c.ends, id)
+	c.extra -= uint64(len(ends) - 1)
+	return len(ends)
+}
+
+// rename moves the log ends to the new ids of the items after a queue migration
+func (c *coalescedItems) rename(ids map[uint64]uint64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ends := make(map[uint64][]int, len(c.ends))
+	c.extra = 0
+	for old, id := range ids {
+		if e, ok := c.ends[old]; ok {
+			ends[id] = e
+			c.extra += uint64(len(e) - 1)
+		}
+	}
+	c.ends = ends
+}
+
+// extraLogs returns the queued logs beyond one per item
+func (c *coalescedItems) extraLogs() uint64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.extra
+}
+
+// splitLogs returns the logs of an item ending at ends
+func (l *LogzioSender) splitLogs(value []byte, ends []int) [][]byte {
+	logs := make([][]byte, 0, len(ends))
+	start := 0
+	for _, end := range ends {
+		logs = append(logs, value[start:end])
+		start = end
+		if !l.noNewline {
+			start++
+		}
+	}
+	return logs
+}
+
+// joinLogs joins logs into one item the way the write buffer does and returns the ends of the logs
+func (l *LogzioSender) joinLogs(logs [][]byte) ([]byte, []int) {
+	size := 0
+	for _, log := range logs {
+		size += len(log) + 1
+	}
+	value := make([]byte, 0, size)
+	ends := make([]int, 0, len(logs))
+	for i, log := range logs {
+		if i > 0 && !l.noNewline {
+			value = append(value, '\n')
+		}
+		value = append(value, log...)
+		ends = append(ends, len(value))
+	}
+	return value, ends
+}
+
+// SetWriteBuffer to join logs into queue items of up to size bytes before enqueuing them, 0 disables it.
+// There is no flush timer, the buffer is flushed into the queue when it is full and at the start of
+// each drain, so the logs are queued by the drain timer at the latest and none are lost by Stop.
+// The joined logs still count one by one in QueueCount, SetLogCountLimit and the drain results
+func SetWriteBuffer(size int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if size < 0 || size > maxSize {
+			return fmt.Errorf("invalid write buffer size %d", size)
+		}
+		l.writeBuffer = nil
+		if size > 0 {
+			l.writeBuffer = &writeBuffer{size: size}
+		}
+		return nil
+	}
+}
+
+// enqueueLog enqueues a log of Send or Write, through the write buffer when there is one
+func (l *LogzioSender) enqueueLog(payload []byte, owned bool) error {
+	if truncated := l.truncate(payload); len(truncated) != len(payload) {
+		// the truncated log is a copy
+		payload, owned = truncated, true
+	}
+	if l.writeBuffer == nil {
+		return l.enqueueOwned(payload, owned)
+	}
+	if l.sanitizeUTF8 {
+		// before the log ends are taken
+		payload = toValidUTF8(payload)
+	}
+	w := l.writeBuffer
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	separator := 0
+	if len(w.data) > 0 && !l.noNewline {
+		separator = 1
+	}
+	if len(w.data)+separator+len(payload) > w.size {
+		if err := l.flushWriteBufferLocked(); err != nil {
+			// the buffered logs wait for the next flush, the log is queued on its own
+			return l.enqueueOwned(payload, owned)
+		}
+		separator = 0
+	}
+	if len(payload) >= w.size {
+		return l.enqueueOwned(payload, owned)
+	}
+	if w.data == nil {
+		w.data = make([]byte, 0, w.size)
+	}
+	if separator > 0 {
+		w.data = append(w.data, '\n')
+	}
+	w.data = append(w.data, payload...)
+	w.ends = append(w.ends, len(w.data))
+	return nil
+}
+
+// flushWriteBuffer enqueues the buffered logs
+func (l *LogzioSender) flushWriteBuffer() {
+	if l.writeBuffer == nil {
+		return
+	}
+	l.writeBuffer.mux.Lock()
+	defer l.writeBuffer.mux.Unlock()
+	if err := l.flushWriteBufferLocked(); err != nil {
+		l.errorLog("logziosender.go: Error flushing the write buffer, keeping %d logs buffered %s\n", len(l.writeBuffer.ends), err)
+	}
+}
+
+func (l *LogzioSender) flushWriteBufferLocked() error {
+	w := l.writeBuffer
+	if len(w.data) == 0 {
+		return nil
+	}
+	var ends []int
+	if len(w.ends) > 1 {
+		ends = w.ends
+	}
+	// the buffered logs stay buffered when they can't be queued
+	if err := l.enqueueItem(w.data, true, ends); err != nil {
+		return err
+	}
+	// the in-memory queue keeps data, the next logs go to a new buffer
+	w.data, w.ends = nil, nil
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetWriteBuffer(t *testing.T) {
+	var (
+		mux  sync.Mutex
+		sent []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		sent = append(sent, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")...)
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetTempDirectory(fmt.Sprintf("%s/logzio-write-buffer-%d", os.TempDir(), time.Now().UnixNano())),
+		SetCheckDiskSpace(false),
+		SetDrainDuration(time.Hour),
+		SetWriteBuffer(64),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	var expected []string
+	for i := 0; i < 20; i++ {
+		log := fmt.Sprintf("log-%02d", i)
+		expected = append(expected, log)
+		if err := l.Send([]byte(log)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 9 logs of 6 bytes and their newlines per item, the last 2 logs are still buffered
+	if l.QueueCount() != 18 {
+		t.Fatalf("%d logs queued", l.QueueCount())
+	}
+	l.Stop()
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected logs sent %q", sent)
+	}
+}
+
+func TestSetWriteBuffer_LargeLog(t *testing.T) {
+	l, err := New("fake-token", SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetWriteBuffer(8), SetRetryPolicy(noRetryPolicy{}), SetUrl("http://localhost:12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("abc"))
+	l.Send([]byte("larger than the buffer"))
+	var out strings.Builder
+	l.ExportQueue(&out)
+	if out.String() != "abc\nlarger than the buffer\n" {
+		t.Fatalf("Unexpected queue %q", out.String())
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetWriteBuffer(-1)); err == nil {
+		t.Fatal("Expected an error for a negative write buffer size")
+	}
+}
+
+func TestSetWriteBuffer_FailedFlush(t *testing.T) {
+	var (
+		mux  sync.Mutex
+		sent []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		sent = append(sent, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")...)
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(3),
+		SetDrainDuration(time.Hour),
+		SetWriteBuffer(16),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	// a log as large as the buffer is queued on its own
+	if err := l.Send([]byte("larger-than-buf!")); err != nil {
+		t.Fatal(err)
+	}
+	for _, log := range []string{"aaa1", "aaa2", "aaa3"} {
+		if err := l.Send([]byte(log)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the 3 buffered logs don't fit next to the queued one, they stay buffered and the log is queued
+	if err := l.Send([]byte("bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if l.QueueCount() != 2 {
+		t.Fatalf("%d logs queued", l.QueueCount())
+	}
+	if result := l.DrainWithResult(); result.SentLogs != 2 {
+		t.Fatalf("%d logs sent by the first drain", result.SentLogs)
+	}
+	if l.QueueCount() != 0 {
+		t.Fatalf("%d logs queued after the first drain", l.QueueCount())
+	}
+	// the 3 logs joined in one item fill the queue
+	if result := l.DrainWithResult(); result.SentLogs != 3 {
+		t.Fatalf("%d logs sent by the second drain", result.SentLogs)
+	}
+	if m := l.Metrics(); m.DroppedLogs != 0 {
+		t.Fatalf("%d logs dropped", m.DroppedLogs)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if strings.Join(sent, ",") != "larger-than-buf!,bbbb,aaa1,aaa2,aaa3" {
+		t.Fatalf("Unexpected logs sent %q", sent)
+	}
+}
+
+func TestSetWriteBuffer_CountLimit(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(3),
+		SetDrainDuration(time.Hour),
+		SetWriteBuffer(64),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.queue.Close()
+	for _, log := range []string{"aaa1", "aaa2", "aaa3"} {
+		if err := l.Send([]byte(log)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.flushWriteBuffer()
+	if l.QueueCount() != 3 {
+		t.Fatalf("%d logs queued", l.QueueCount())
+	}
+	// the coalesced item holds as many logs as the limit
+	if err := l.enqueue([]byte("bbbb")); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull for a log beyond the limit, got %v", err)
+	}
+}
+
+func BenchmarkSend_WriteBuffer(b *testing.B) {
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("buffer-%d", size), func(b *testing.B) {
+			l, err := New(
+				"fake-token",
+				SetUrl("http://localhost:12345"),
+				SetTempDirectory(fmt.Sprintf("%s/logzio-write-buffer-bench-%d", os.TempDir(), time.Now().UnixNano())),
+				SetCheckDiskSpace(false),
+				SetDrainDuration(time.Hour),
+				SetRetryPolicy(noRetryPolicy{}),
+				SetWriteBuffer(size),
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(l.dir)
+			log := []byte(`{"message":"tiny"}`)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.Send(log)
+			}
+			b.StopTimer()
+			b.Logf("%d queue items for %d logs", l.QueueCount(), b.N)
+			l.queue.Close()
+		})
+	}
+}
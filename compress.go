@@ -0,0 +1,175 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const gzipEncoding = "gzip"
+
+// SetCompress to gzip the request body
+func SetCompress(compress bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.compress = compress
+		return nil
+	}
+}
+
+// SetDiskCompress to gzip each item of the disk queue, the logs are decompressed when dequeued so
+// SetCompress alone decides the request encoding. Small logs take more space compressed
+func SetDiskCompress(compress bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskCompress = compress
+		return nil
+	}
+}
+
+// SetStreamCompression to gzip the request body while it is sent instead of compressing the whole
+// batch first, the request is sent with chunked encoding
+func SetStreamCompression(stream bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.streamCompression = stream
+		return nil
+	}
+}
+
+// SetForceContentLength to buffer the whole request body before it is sent so the request has a
+// Content-Length, for proxies that mishandle chunked encoding. It overrides SetStreamCompression
+func SetForceContentLength(force bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.forceLength = force
+		return nil
+	}
+}
+
+// SetNegotiateCompression to lock in gzip or no compression according to the Accept-Encoding
+// header of the first listener response. Only gzip is available, a listener advertising other
+// codecs only (e.g. zstd) is sent uncompressed requests
+func SetNegotiateCompression(negotiate bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.negotiateCompression = negotiate
+		return nil
+	}
+}
+
+// compressItem gzips a log for the disk queue, it is kept as is when it can't be compressed
+func compressItem(p []byte) []byte {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(p); err != nil {
+		return p
+	}
+	if err := w.Close(); err != nil {
+		return p
+	}
+	return compressed.Bytes()
+}
+
+// itemLogs returns the logs of a queued item, how many times they were requeued and whether the item
+// is a requeued batch. Items are decompressed whatever SetDiskCompress is, the queue may hold items
+// of a previous run
+func itemLogs(value []byte) ([]byte, int, bool) {
+	if len(value) > 1 && value[0] == 0x1f && value[1] == 0x8b {
+		if r, err := gzip.NewReader(bytes.NewReader(value)); err == nil {
+			// a log that only looks like gzip is sent as is
+			if logs, err := ioutil.ReadAll(r); err == nil {
+				value = logs
+			}
+		}
+	}
+	return stripRequeues(value)
+}
+
+// requestReader returns a reader of the body to send for the batch data and its content encoding
+func (l *LogzioSender) requestReader(data []byte) (io.Reader, string, error) {
+	if l.compress && l.streamCompression && !l.forceLength {
+		return gzipStream(data), gzipEncoding, nil
+	}
+	body, encoding, err := l.requestBody(data)
+	if err != nil {
+		return nil, "", err
+	}
+	// the body is read through a separate reader so retries and requeue see the whole batch
+	return bytes.NewReader(body), encoding, nil
+}
+
+// gzipStream compresses data into a pipe as the request reads it, a compression error fails the
+// request and closing the reader stops the compression
+func gzipStream(data []byte) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(w)
+		_, err := gz.Write(data)
+		if err == nil {
+			err = gz.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r
+}
+
+// requestBody returns the body to send for the batch data and its content encoding
+func (l *LogzioSender) requestBody(data []byte) ([]byte, string, error) {
+	if !l.compress {
+		return data, "", nil
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return compressed.Bytes(), gzipEncoding, nil
+}
+
+// negotiateEncoding locks in the compression supported by the listener, once
+func (l *LogzioSender) negotiateEncoding(acceptEncoding string) {
+	if !l.negotiateCompression || l.compressionNegotiated {
+		return
+	}
+	l.compressionNegotiated = true
+	l.compress = acceptsEncoding(acceptEncoding, gzipEncoding)
+	l.infoLog("logziosender.go: Listener accepts encoding %q, compress is %v\n", acceptEncoding, l.compress)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows the encoding
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), encoding) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			// q=0 means not acceptable
+			if q, err := strconv.ParseFloat(param[len("q="):], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"zstd":              false,
+		"zstd, gzip":        true,
+		"GZIP;q=0.5, zstd":  true,
+		"gzip;q=0, zstd":    false,
+		"gzip; q=0.000":     false,
+		"deflate, identity": false,
+	}
+	for header, expected := range cases {
+		if acceptsEncoding(header, gzipEncoding) != expected {
+			t.Errorf("Accept-Encoding %q, expected %v", header, expected)
+		}
+	}
+}
+
+func TestLogzioSender_Compress(t *testing.T) {
+	var sent []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Unexpected Content-Encoding %q", r.Header.Get("Content-Encoding"))
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sent, _ = ioutil.ReadAll(gz)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetCompress(true), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	l.Drain()
+	if string(sent) != "blah\n" {
+		t.Fatalf("Unexpected body %q", sent)
+	}
+}
+
+func TestLogzioSender_NegotiateCompression(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		expected       []string
+	}{
+		{"zstd", []string{"", "", ""}},
+		{"zstd, gzip", []string{"", "gzip", "gzip"}},
+	}
+	for _, c := range cases {
+		var encodings []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings = append(encodings, r.Header.Get("Content-Encoding"))
+			w.Header().Set("Accept-Encoding", c.acceptEncoding)
+			w.WriteHeader(http.StatusOK)
+		}))
+		l, err := New("fake-token", SetUrl(ts.URL), SetNegotiateCompression(true), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range c.expected {
+			l.Send([]byte("blah"))
+			l.Drain()
+		}
+		l.Stop()
+		ts.Close()
+		if len(encodings) != len(c.expected) {
+			t.Fatalf("Unexpected requests %q for %q", encodings, c.acceptEncoding)
+		}
+		for i := range encodings {
+			if encodings[i] != c.expected[i] {
+				t.Fatalf("%q != %q for %q", encodings, c.expected, c.acceptEncoding)
+			}
+		}
+	}
+}
+
+func TestLogzioSender_StreamCompression(t *testing.T) {
+	var (
+		bodies  []string
+		lengths []int64
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(gz)
+		bodies = append(bodies, string(body))
+		lengths = append(lengths, r.ContentLength)
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetCompress(true),
+		SetStreamCompression(true),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(zeroWaitRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("first"))
+	l.Send([]byte("second"))
+	if res := l.DrainWithResult(); res.SentLogs != 2 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	// the retry streams the whole batch again
+	if len(bodies) != 2 || bodies[0] != "first\nsecond\n" || bodies[1] != bodies[0] {
+		t.Fatalf("Unexpected bodies %q", bodies)
+	}
+	if lengths[0] != -1 {
+		t.Fatalf("Unexpected content length %d, expected a chunked request", lengths[0])
+	}
+}
+
+func TestLogzioSender_ForceContentLength(t *testing.T) {
+	var (
+		body   string
+		length int64
+		chunks []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(gz)
+		body, length, chunks = string(b), r.ContentLength, r.TransferEncoding
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetCompress(true),
+		SetStreamCompression(true),
+		SetForceContentLength(true),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("first"))
+	if res := l.DrainWithResult(); res.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if body != "first\n" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+	if length <= 0 || len(chunks) != 0 {
+		t.Fatalf("Expected a Content-Length, got %d with transfer encoding %v", length, chunks)
+	}
+}
+
+func TestGzipStream_Closed(t *testing.T) {
+	// closing the reader, like the transport does on errors, stops the compression
+	r := gzipStream(make([]byte, 1024*1024))
+	r.Close()
+	if _, err := ioutil.ReadAll(r); err != io.ErrClosedPipe {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+type zeroWaitRetryPolicy struct{}
+
+func (zeroWaitRetryPolicy) ShouldRetry(statusCode int, attempt int) (bool, time.Duration) {
+	retry, _ := DefaultRetryPolicy{}.ShouldRetry(statusCode, attempt)
+	return retry, 0
+}
+
+func BenchmarkLogzioSender_StreamCompression(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	batch := []byte(hex.EncodeToString(data))
+	for _, stream := range []bool{false, true} {
+		b.Run(fmt.Sprintf("stream=%v", stream), func(b *testing.B) {
+			l, _ := New("fake-token", SetUrl(ts.URL), SetCompress(true), SetStreamCompression(stream), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+			defer l.Stop()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.tryToSendLogs(batch)
+			}
+		})
+	}
+}
+
+func TestDiskCompress(t *testing.T) {
+	for _, tc := range []struct{ disk, transport bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+		var body, encoding string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			var reader io.Reader = r.Body
+			if encoding == gzipEncoding {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				reader = gz
+			}
+			b, _ := ioutil.ReadAll(reader)
+			body = string(b)
+			w.WriteHeader(http.StatusOK)
+		}))
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetTempDirectory(fmt.Sprintf("%s/logzio-disk-compress-%d", os.TempDir(), time.Now().UnixNano())),
+			SetCheckDiskSpace(false),
+			SetDrainDuration(time.Hour),
+			SetDiskCompress(tc.disk),
+			SetCompress(tc.transport),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := strings.Repeat(`{"message":"compressible"}`, 20)
+		l.Send([]byte(log))
+		item, err := l.queue.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := len(item.Value) < len(log); stored != tc.disk {
+			t.Errorf("%+v: stored %d bytes for a log of %d bytes", tc, len(item.Value), len(log))
+		}
+		if peek := l.PeekQueue(1); len(peek) != 1 || string(peek[0]) != log {
+			t.Errorf("%+v: unexpected peeked logs %q", tc, peek)
+		}
+		if res := l.DrainWithResult(); res.SentLogs != 1 {
+			t.Errorf("%+v: unexpected result %+v", tc, res)
+		}
+		if body != log+"\n" {
+			t.Errorf("%+v: unexpected body %q", tc, body)
+		}
+		if (encoding == gzipEncoding) != tc.transport {
+			t.Errorf("%+v: unexpected content encoding %q", tc, encoding)
+		}
+		l.Stop()
+		os.RemoveAll(l.dir)
+		ts.Close()
+	}
+}
+
+func TestItemLogs_NotGzip(t *testing.T) {
+	value := []byte{0x1f, 0x8b, 'n', 'o', 't'}
+	if logs, _, _ := itemLogs(value); string(logs) != string(value) {
+		t.Fatalf("Unexpected logs %q", logs)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config of a sender for NewFromConfig, a zero value keeps the default of its option
+type Config struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+	Name  string `json:"name"`
+
+	// listener, ListenerHost replaces URL when it is set
+	ListenerHost   string            `json:"listenerHost"`
+	ListenerPort   int               `json:"listenerPort"`
+	ListenerSecure bool              `json:"listenerSecure"`
+	QueryParams    map[string]string `json:"queryParams"`
+
+	DrainDuration       time.Duration `json:"drainDuration"`
+	AlignedDrain        time.Duration `json:"alignedDrain"`
+	MaxDrainDuration    time.Duration `json:"maxDrainDuration"`
+	StartupJitter       time.Duration `json:"startupJitter"`
+	MaxLifetime         time.Duration `json:"maxLifetime"`
+	VerifyOnStart       bool          `json:"verifyOnStart"`
+	Warmup              bool          `json:"warmup"`
+	Synchronous         bool          `json:"synchronous"`
+	FailFastSends       bool          `json:"failFastSends"`
+	MaxConcurrentSends  int           `json:"maxConcurrentSends"`
+	ContentType         string        `json:"contentType"`
+	HTTPMethod          string        `json:"httpMethod"`
+	MaxBatchCount       int           `json:"maxBatchCount"`
+	MaxRequestBytes     int           `json:"maxRequestBytes"`
+	MaxInFlightBytes    uint64        `json:"maxInFlightBytes"`
+	TrimTrailingNewline bool          `json:"trimTrailingNewline"`
+	DisableRetryOn404   bool          `json:"disableRetryOn404"`
+
+	// heartbeat, enabled when HeartbeatInterval is set
+	HeartbeatInterval time.Duration `json:"heartbeatInterval"`
+	HeartbeatPayload  string        `json:"heartbeatPayload"`
+
+	// connection
+	ConnectTimeout time.Duration `json:"connectTimeout"`
+	MinTLSVersion  uint16        `json:"minTLSVersion"`
+	UnixSocket     string        `json:"unixSocket"`
+
+	// queue
+	TempDirectory               string     `json:"tempDirectory"`
+	QueueName                   string     `json:"queueName"`
+	InMemoryQueue               bool       `json:"inMemoryQueue"`
+	InMemoryCapacity            uint64     `json:"inMemoryCapacity"`
+	LogCountLimit               int        `json:"logCountLimit"`
+	FallbackToMemoryOnDiskError bool       `json:"fallbackToMemoryOnDiskError"`
+	DisableDiskCheck            bool       `json:"disableDiskCheck"`
+	DrainDiskThreshold          int        `json:"drainDiskThreshold"`
+	DiskCheckLowWaterMark       uint64     `json:"diskCheckLowWaterMark"`
+	FullPolicy                  FullPolicy `json:"fullPolicy"`
+	DrainOnFull                 bool       `json:"drainOnFull"`
+	MaxRequeues                 int        `json:"maxRequeues"`
+	MaxBufferCapacity           int        `json:"maxBufferCapacity"`
+
+	DiskCompress        bool                    `json:"diskCompress"`
+	DiskUsageFallback   uint64                  `json:"diskUsageFallback"`
+	OnIncompatibleQueue IncompatibleQueuePolicy `json:"onIncompatibleQueue"`
+	SyncOnStop          bool                    `json:"syncOnStop"`
+	DestructiveExport   bool                    `json:"destructiveExport"`
+	WriteBuffer         int                     `json:"writeBuffer"`
+	DropLogInterval     time.Duration           `json:"dropLogInterval"`
+
+	// payloads
+	SplitLines           bool   `json:"splitLines"`
+	KeepEmpty            bool   `json:"keepEmpty"`
+	SanitizeUTF8         bool   `json:"sanitizeUTF8"`
+	MaxItemsPerCall      int    `json:"maxItemsPerCall"`
+	DisableAppendNewline bool   `json:"disableAppendNewline"`
+	DedupWindow          int    `json:"dedupWindow"`
+	MaxLineBytes         int    `json:"maxLineBytes"`
+	TruncationMarker     string `json:"truncationMarker"`
+	TruncateJSONField    string `json:"truncateJSONField"`
+	LinePrefix           string `json:"linePrefix"`
+	LineSuffix           string `json:"lineSuffix"`
+
+	// stale logs, dropped when StaleField is set
+	StaleField  string        `json:"staleField"`
+	StaleMaxAge time.Duration `json:"staleMaxAge"`
+
+	// compression
+	Compress             bool `json:"compress"`
+	StreamCompression    bool `json:"streamCompression"`
+	NegotiateCompression bool `json:"negotiateCompression"`
+	ForceContentLength   bool `json:"forceContentLength"`
+
+	// proxy
+	ProxyURL      string `json:"proxyUrl"`
+	ProxyUser     string `json:"proxyUser"`
+	ProxyPassword string `json:"proxyPassword"`
+
+	// circuit breaker, enabled when CircuitBreakerFailures is set
+	CircuitBreakerFailures int           `json:"circuitBreakerFailures"`
+	CircuitBreakerCooldown time.Duration `json:"circuitBreakerCooldown"`
+
+	// debug, DebugLevel is one of error, warn, info or debug
+	Debug           io.Writer `json:"-"`
+	DebugLevel      string    `json:"debugLevel"`
+	StructuredDebug bool      `json:"structuredDebug"`
+
+	RetryPolicy           RetryPolicy                            `json:"-"`
+	Sink                  Sink                                   `json:"-"`
+	BufferPool            *sync.Pool                             `json:"-"`
+	SharedTransport       *http.Transport                        `json:"-"`
+	QueueStateCallback    func(full bool)                        `json:"-"`
+	DrainProgressCallback func(sentBytes, remainingBytes uint64) `json:"-"`
+	PoisonCallback        func(err *PoisonBatchError)            `json:"-"`
+	SuccessStatus         func(statusCode int) bool              `json:"-"`
+	RequestDecorator      func(req *http.Request)                `json:"-"`
+	RequestInterceptor    func(req *http.Request) error          `json:"-"`
+	ResponseInterceptor   func(resp *http.Response) error        `json:"-"`
+	Marshaler             func(v interface{}) ([]byte, error)    `json:"-"`
+	ArchiveWriter         io.Writer                              `json:"-"`
+	RestoreFrom           io.Reader                              `json:"-"`
+}
+
+// NewFromConfig creates a new Logzio sender with the options of cfg
+func NewFromConfig(cfg Config) (*LogzioSender, error) {
+	return New(cfg.Token, cfg.options()...)
+}
+
+func (cfg Config) options() []SenderOptionFunc {
+	var options []SenderOptionFunc
+	add := func(set bool, option SenderOptionFunc) {
+		if set {
+			options = append(options, option)
+		}
+	}
+	add(cfg.Debug != nil, SetDebug(cfg.Debug))
+	add(cfg.DebugLevel != "", setDebugLevelName(cfg.DebugLevel))
+	add(cfg.StructuredDebug, SetStructuredDebug(true))
+	add(cfg.Name != "", SetName(cfg.Name))
+	add(cfg.URL != "", SetUrl(cfg.URL))
+	add(cfg.ListenerHost != "", SetListener(cfg.ListenerHost, cfg.ListenerPort, cfg.ListenerSecure))
+	keys := make([]string, 0, len(cfg.QueryParams))
+	for key := range cfg.QueryParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(true, SetQueryParam(key, cfg.QueryParams[key]))
+	}
+	add(cfg.DrainDuration != 0, SetDrainDuration(cfg.DrainDuration))
+	add(cfg.AlignedDrain != 0, SetAlignedDrain(cfg.AlignedDrain))
+	add(cfg.MaxDrainDuration != 0, SetMaxDrainDuration(cfg.MaxDrainDuration))
+	add(cfg.StartupJitter != 0, SetStartupJitter(cfg.StartupJitter))
+	add(cfg.MaxLifetime != 0, SetMaxLifetime(cfg.MaxLifetime))
+	add(cfg.VerifyOnStart, SetVerifyOnStart(true))
+	add(cfg.Warmup, SetWarmup(true))
+	add(cfg.Synchronous, SetSynchronous(true))
+	add(cfg.FailFastSends, SetFailFastSends(true))
+	add(cfg.MaxConcurrentSends != 0, SetMaxConcurrentSends(cfg.MaxConcurrentSends))
+	add(cfg.ContentType != "", SetContentType(cfg.ContentType))
+	add(cfg.HTTPMethod != "", SetHTTPMethod(cfg.HTTPMethod))
+	add(cfg.MaxBatchCount != 0, SetMaxBatchCount(cfg.MaxBatchCount))
+	add(cfg.MaxRequestBytes != 0, SetMaxRequestBytes(cfg.MaxRequestBytes))
+	add(cfg.MaxInFlightBytes != 0, SetMaxInFlightBytes(cfg.MaxInFlightBytes))
+	add(cfg.TrimTrailingNewline, SetTrimTrailingNewline(true))
+	add(cfg.DisableRetryOn404, SetRetryOn404(false))
+	add(cfg.HeartbeatInterval != 0, SetHeartbeat(cfg.HeartbeatInterval, []byte(cfg.HeartbeatPayload)))
+	add(cfg.ConnectTimeout != 0, SetConnectTimeout(cfg.ConnectTimeout))
+	add(cfg.MinTLSVersion != 0, SetMinTLSVersion(cfg.MinTLSVersion))
+	add(cfg.UnixSocket != "", SetUnixSocket(cfg.UnixSocket))
+	add(cfg.TempDirectory != "", SetTempDirectory(cfg.TempDirectory))
+	add(cfg.QueueName != "", SetQueueName(cfg.QueueName))
+	add(cfg.InMemoryQueue, SetInMemoryQueue(true))
+	add(cfg.InMemoryCapacity != 0, SetInMemoryCapacity(cfg.InMemoryCapacity))
+	add(cfg.LogCountLimit != 0, SetLogCountLimit(cfg.LogCountLimit))
+	add(cfg.FallbackToMemoryOnDiskError, SetFallbackToMemoryOnDiskError(true))
+	add(cfg.DisableDiskCheck, SetCheckDiskSpace(false))
+	add(cfg.DrainDiskThreshold != 0, SetDrainDiskThreshold(cfg.DrainDiskThreshold))
+	add(cfg.DiskCheckLowWaterMark != 0, SetDiskCheckLowWaterMark(cfg.DiskCheckLowWaterMark))
+	add(cfg.FullPolicy != DropNewest, SetFullPolicy(cfg.FullPolicy))
+	add(cfg.DrainOnFull, SetDrainOnFull(true))
+	add(cfg.MaxRequeues != 0, SetMaxRequeues(cfg.MaxRequeues))
+	add(cfg.MaxBufferCapacity != 0, SetMaxBufferCapacity(cfg.MaxBufferCapacity))
+	add(cfg.DiskCompress, SetDiskCompress(true))
+	add(cfg.DiskUsageFallback != 0, SetDiskUsageFallback(cfg.DiskUsageFallback))
+	add(cfg.OnIncompatibleQueue != FailIncompatibleQueue, SetOnIncompatibleQueue(cfg.OnIncompatibleQueue))
+	add(cfg.SyncOnStop, SetSyncOnStop(true))
+	add(cfg.DestructiveExport, SetDestructiveExport(true))
+	add(cfg.WriteBuffer != 0, SetWriteBuffer(cfg.WriteBuffer))
+	add(cfg.DropLogInterval != 0, SetDropLogInterval(cfg.DropLogInterval))
+	add(cfg.SplitLines, SetSplitLines(true))
+	add(cfg.KeepEmpty, SetSkipEmpty(false))
+	add(cfg.SanitizeUTF8, SetSanitizeUTF8(true))
+	add(cfg.MaxItemsPerCall != 0, SetMaxItemsPerCall(cfg.MaxItemsPerCall))
+	add(cfg.DisableAppendNewline, SetAppendNewline(false))
+	add(cfg.DedupWindow != 0, SetDedup(cfg.DedupWindow))
+	add(cfg.MaxLineBytes != 0, SetMaxLineBytes(cfg.MaxLineBytes))
+	add(cfg.TruncationMarker != "", SetTruncationMarker(cfg.TruncationMarker))
+	add(cfg.TruncateJSONField != "", SetTruncateJSONField(cfg.TruncateJSONField))
+	add(cfg.LinePrefix != "", SetLinePrefix([]byte(cfg.LinePrefix)))
+	add(cfg.LineSuffix != "", SetLineSuffix([]byte(cfg.LineSuffix)))
+	add(cfg.StaleField != "", SetDropStaleByField(cfg.StaleField, cfg.StaleMaxAge))
+	add(cfg.Compress, SetCompress(true))
+	add(cfg.StreamCompression, SetStreamCompression(true))
+	add(cfg.ForceContentLength, SetForceContentLength(true))
+	add(cfg.NegotiateCompression, SetNegotiateCompression(true))
+	add(cfg.ProxyURL != "", SetProxy(cfg.ProxyURL))
+	add(cfg.ProxyUser != "" || cfg.ProxyPassword != "", SetProxyBasicAuth(cfg.ProxyUser, cfg.ProxyPassword))
+	add(cfg.CircuitBreakerFailures != 0, SetCircuitBreaker(cfg.CircuitBreakerFailures, cfg.CircuitBreakerCooldown))
+	add(cfg.RetryPolicy != nil, SetRetryPolicy(cfg.RetryPolicy))
+	add(cfg.Sink != nil, SetSink(cfg.Sink))
+	add(cfg.BufferPool != nil, SetBufferPool(cfg.BufferPool))
+	add(cfg.SharedTransport != nil, SetSharedTransport(cfg.SharedTransport))
+	add(cfg.QueueStateCallback != nil, SetQueueStateCallback(cfg.QueueStateCallback))
+	add(cfg.DrainProgressCallback != nil, SetDrainProgressCallback(cfg.DrainProgressCallback))
+	add(cfg.PoisonCallback != nil, SetPoisonCallback(cfg.PoisonCallback))
+	add(cfg.SuccessStatus != nil, SetSuccessStatus(cfg.SuccessStatus))
+	add(cfg.RequestDecorator != nil, SetRequestDecorator(cfg.RequestDecorator))
+	add(cfg.RequestInterceptor != nil, SetRequestInterceptor(cfg.RequestInterceptor))
+	add(cfg.ResponseInterceptor != nil, SetResponseInterceptor(cfg.ResponseInterceptor))
+	add(cfg.Marshaler != nil, SetMarshaler(cfg.Marshaler))
+	add(cfg.ArchiveWriter != nil, SetArchiveWriter(cfg.ArchiveWriter))
+	add(cfg.RestoreFrom != nil, SetRestoreFrom(cfg.RestoreFrom))
+	return options
+}
+
+func setDebugLevelName(name string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		for level := DebugLevelError; level <= DebugLevelDebug; level++ {
+			if strings.EqualFold(name, level.String()) {
+				return SetDebugLevel(level)(l)
+			}
+		}
+		return fmt.Errorf("invalid debug level %q", name)
+	}
+}
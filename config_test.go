@@ -0,0 +1,204 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewFromConfig(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{
+		"token": "fake-token",
+		"url": "http://localhost:12345",
+		"drainDuration": 3600000000000,
+		"inMemoryQueue": true,
+		"inMemoryCapacity": 1024,
+		"fullPolicy": 1,
+		"compress": true,
+		"contentType": "application/json",
+		"keepEmpty": true,
+		"maxBatchCount": 10,
+		"circuitBreakerFailures": 3,
+		"circuitBreakerCooldown": 60000000000,
+		"debugLevel": "WARN"
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromConfig, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromConfig.Stop()
+	fromOptions, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetDrainDuration(time.Hour),
+		SetInMemoryQueue(true),
+		SetInMemoryCapacity(1024),
+		SetFullPolicy(DropOldest),
+		SetCompress(true),
+		SetContentType("application/json"),
+		SetSkipEmpty(false),
+		SetMaxBatchCount(10),
+		SetCircuitBreaker(3, time.Minute),
+		SetDebugLevel(DebugLevelWarn),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromOptions.Stop()
+
+	type settings struct {
+		url              string
+		drainDuration    time.Duration
+		inMemoryQueue    bool
+		inMemoryCapacity uint64
+		logCountLimit    int
+		fullPolicy       FullPolicy
+		compress         bool
+		contentType      string
+		keepEmpty        bool
+		maxBatchCount    int
+		breaker          circuitBreaker
+		debugLevel       DebugLevel
+		checkDiskSpace   bool
+		retryPolicy      RetryPolicy
+	}
+	get := func(l *LogzioSender) settings {
+		return settings{
+			l.url.Load(), l.drainDuration, l.inMemoryQueue, l.inMemoryCapacity, l.logCountLimit, l.fullPolicy,
+			l.compress, l.contentType, l.keepEmpty, l.maxBatchCount, *l.breaker, l.debugLevel, l.checkDiskSpace, l.retryPolicy,
+		}
+	}
+	if a, b := get(fromConfig), get(fromOptions); a != b {
+		t.Fatalf("%+v != %+v", a, b)
+	}
+}
+
+func TestNewFromConfig_Zero(t *testing.T) {
+	l, err := NewFromConfig(Config{Token: "fake-token", InMemoryQueue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if l.url.Load() != "https://listener.logz.io:8071/?token=fake-token" || l.drainDuration != defaultDrainDuration ||
+		l.contentType != defaultContentType || l.debugLevel != DebugLevelDebug || !l.checkDiskSpace || l.breaker != nil {
+		t.Fatal("zero values don't keep the defaults")
+	}
+	if _, err := NewFromConfig(Config{Token: "fake-token", InMemoryQueue: true, DebugLevel: "verbose"}); err == nil {
+		t.Fatal("expected an error for an invalid debug level")
+	}
+}
+
+// TestConfig_AllOptions fails when an option of the package has no Config field or a field isn't applied
+func TestConfig_AllOptions(t *testing.T) {
+	// the fields named otherwise than their option
+	fields := map[string]string{
+		"SetUrl":              "URL",
+		"SetListener":         "ListenerHost",
+		"SetQueryParam":       "QueryParams",
+		"SetCheckDiskSpace":   "DisableDiskCheck",
+		"SetAppendNewline":    "DisableAppendNewline",
+		"SetRetryOn404":       "DisableRetryOn404",
+		"SetSkipEmpty":        "KeepEmpty",
+		"SetDedup":            "DedupWindow",
+		"SetDropStaleByField": "StaleField",
+		"SetHeartbeat":        "HeartbeatInterval",
+		"SetProxy":            "ProxyURL",
+		"SetProxyBasicAuth":   "ProxyUser",
+		"SetCircuitBreaker":   "CircuitBreakerFailures",
+	}
+	packages, err := parser.ParseDir(token.NewFileSet(), ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgType := reflect.TypeOf(Config{})
+	for _, file := range packages["logzio"].Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Set") || fn.Type.Results == nil {
+				continue
+			}
+			if result, ok := fn.Type.Results.List[0].Type.(*ast.Ident); !ok || result.Name != "SenderOptionFunc" {
+				continue
+			}
+			field, ok := fields[fn.Name.Name]
+			if !ok {
+				field = strings.TrimPrefix(fn.Name.Name, "Set")
+			}
+			if _, ok := cfgType.FieldByName(field); !ok {
+				t.Errorf("%s has no Config field %s", fn.Name.Name, field)
+			}
+		}
+	}
+
+	// the fields only read with another field
+	companions := map[string]bool{
+		"Token": true, "ListenerPort": true, "ListenerSecure": true, "HeartbeatPayload": true,
+		"StaleMaxAge": true, "ProxyPassword": true, "CircuitBreakerCooldown": true,
+	}
+	values := map[reflect.Type]interface{}{
+		reflect.TypeOf((*io.Writer)(nil)).Elem():   ioutil.Discard,
+		reflect.TypeOf((*io.Reader)(nil)).Elem():   strings.NewReader(""),
+		reflect.TypeOf((*RetryPolicy)(nil)).Elem(): noRetryPolicy{},
+		reflect.TypeOf((*Sink)(nil)).Elem():        &OTLPSink{},
+	}
+	zero := len(Config{}.options())
+	for i := 0; i < cfgType.NumField(); i++ {
+		f := cfgType.Field(i)
+		if companions[f.Name] {
+			continue
+		}
+		var cfg Config
+		v := reflect.ValueOf(&cfg).Elem().Field(i)
+		switch f.Type.Kind() {
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			v.SetInt(1)
+		case reflect.Uint16, reflect.Uint64:
+			v.SetUint(1)
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Map:
+			v.Set(reflect.ValueOf(map[string]string{"key": "value"}))
+		case reflect.Func:
+			v.Set(reflect.MakeFunc(f.Type, func(args []reflect.Value) []reflect.Value { return nil }))
+		case reflect.Ptr:
+			v.Set(reflect.New(f.Type.Elem()))
+		case reflect.Interface:
+			v.Set(reflect.ValueOf(values[f.Type]))
+		default:
+			t.Fatalf("no value for the field %s of kind %s", f.Name, f.Type.Kind())
+		}
+		if len(cfg.options()) == zero {
+			t.Errorf("the Config field %s is not applied", f.Name)
+		}
+	}
+}
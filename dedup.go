@@ -0,0 +1,96 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// dedupWindow remembers the hashes of the last accepted logs in a ring buffer
+type dedupWindow struct {
+	mux    sync.Mutex
+	hashes []uint64
+	next   int
+	full   bool
+	seen   map[uint64]int
+}
+
+// SetDedup to drop a log equal to one of the last windowSize logs sent, 0 disables deduplication.
+// Logs are compared by a 64-bit hash, the drops are counted in Metrics().DedupedLogs
+func SetDedup(windowSize int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if windowSize < 0 {
+			return fmt.Errorf("invalid dedup window size %d", windowSize)
+		}
+		l.dedup = nil
+		if windowSize > 0 {
+			l.dedup = &dedupWindow{hashes: make([]uint64, windowSize), seen: make(map[uint64]int, windowSize)}
+		}
+		return nil
+	}
+}
+
+// isDuplicate reports whether payload is in the window
+func (l *LogzioSender) isDuplicate(payload []byte) bool {
+	if l.dedup == nil || !l.dedup.contains(dedupHash(payload)) {
+		return false
+	}
+	l.dedupedLogs.Inc()
+	l.debugLog("logziosender.go: Dropping duplicate log %s\n", payload)
+	return true
+}
+
+// enqueueDeduped enqueues payload like enqueueLog and adds it to the window once it is queued,
+// a log that couldn't be queued is not a duplicate when it is sent again
+func (l *LogzioSender) enqueueDeduped(payload []byte, owned bool) error {
+	err := l.enqueueLog(payload, owned)
+	if err == nil && l.dedup != nil {
+		l.dedup.add(dedupHash(payload))
+	}
+	return err
+}
+
+func dedupHash(payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64()
+}
+
+func (d *dedupWindow) contains(hash uint64) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.seen[hash] > 0
+}
+
+// add the hash to the window unless it is already there, e.g. after concurrent sends of a log
+func (d *dedupWindow) add(hash uint64) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.seen[hash] > 0 {
+		return
+	}
+	if d.full {
+		old := d.hashes[d.next]
+		if d.seen[old]--; d.seen[old] == 0 {
+			delete(d.seen, old)
+		}
+	}
+	d.hashes[d.next] = hash
+	d.seen[hash]++
+	d.next = (d.next + 1) % len(d.hashes)
+	d.full = d.full || d.next == 0
+}
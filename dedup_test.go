@@ -0,0 +1,116 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSetDedup(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDedup(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for _, log := range []string{"a", "a", "b", "a", "c", "a"} {
+		if err := l.Send([]byte(log)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	l.ExportQueue(&out)
+	// a left the window of the last 2 logs once c was sent
+	if out.String() != "a\nb\nc\na\n" {
+		t.Fatalf("Unexpected queue %q", out.String())
+	}
+	if m := l.Metrics(); m.DedupedLogs != 2 || m.DroppedLogs != 0 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+}
+
+func TestSetDedup_Write(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetSplitLines(true),
+		SetDedup(10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if _, err := l.Write([]byte("one\ntwo\none\nthree\ntwo\n")); err != nil {
+		t.Fatal(err)
+	}
+	if l.QueueCount() != 3 {
+		t.Fatalf("%d logs queued", l.QueueCount())
+	}
+	if m := l.Metrics(); m.DedupedLogs != 2 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+}
+
+func TestSetDedup_QueueFull(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(1),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDestructiveExport(true),
+		SetDedup(10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("a"))
+	if _, err := l.Write([]byte("b")); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+	var out bytes.Buffer
+	l.ExportQueue(&out)
+	// b was not queued, sending it again is not a duplicate
+	if _, err := l.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	l.ExportQueue(&out)
+	if out.String() != "b\n" {
+		t.Fatalf("Unexpected queue %q", out.String())
+	}
+	if m := l.Metrics(); m.DedupedLogs != 0 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+}
+
+func TestSetDedup_Invalid(t *testing.T) {
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetDedup(-1)); err == nil {
+		t.Fatal("Expected an error for a negative window size")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"github.com/beeker1121/goque"
+	"go.uber.org/atomic"
+)
+
+// diskQueue is the goque disk queue with a Length safe to read while items are enqueued and
+// dequeued, goque reads its head and tail without its lock
+type diskQueue struct {
+	*goque.Queue
+	length atomic.Uint64
+}
+
+func newDiskQueue(q *goque.Queue) *diskQueue {
+	d := &diskQueue{Queue: q}
+	d.length.Store(q.Length())
+	return d
+}
+
+// Enqueue adds an item to the end of the queue
+func (q *diskQueue) Enqueue(value []byte) (*goque.Item, error) {
+	item, err := q.Queue.Enqueue(value)
+	if err == nil {
+		q.length.Inc()
+	}
+	return item, err
+}
+
+// Dequeue removes the next item from the queue and returns it
+func (q *diskQueue) Dequeue() (*goque.Item, error) {
+	item, err := q.Queue.Dequeue()
+	if err == nil {
+		q.length.Dec()
+	}
+	return item, err
+}
+
+// Length returns the number of items in the queue
+func (q *diskQueue) Length() uint64 {
+	return q.length.Load()
+}
+
+// Close closes the queue, its length is reset like goque resets its head and tail
+func (q *diskQueue) Close() {
+	q.Queue.Close()
+	q.length.Store(0)
+}
+
+// Drop closes the queue and deletes its directory
+func (q *diskQueue) Drop() {
+	q.Queue.Drop()
+	q.length.Store(0)
+}
@@ -0,0 +1,44 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+// TriggerFlush requests a drain without waiting for it, e.g. to flush from an event loop when a
+// request completes. Triggers during a drain are coalesced into a single next drain. It never
+// blocks, the triggers after Stop are ignored
+func (l *LogzioSender) TriggerFlush() {
+	l.triggerOnce.Do(func() {
+		l.trigger = make(chan struct{}, 1)
+		go l.drainOnTrigger()
+	})
+	select {
+	case l.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LogzioSender) drainOnTrigger() {
+	for {
+		select {
+		case <-l.trigger:
+			if l.stopped.Load() {
+				return
+			}
+			l.debugLog("logziosender.go: Flush triggered\n")
+			l.Drain()
+		case <-l.stopping:
+			return
+		}
+	}
+}
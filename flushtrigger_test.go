@@ -0,0 +1,75 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_FlushTrigger(t *testing.T) {
+	bodies := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	l.TriggerFlush()
+	select {
+	case body := <-bodies:
+		if body != "blah\n" {
+			t.Fatalf("Unexpected body %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No drain after the trigger")
+	}
+
+	// rapid triggers are coalesced, the callers aren't blocked
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			l.TriggerFlush()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Blocked triggering flushes")
+	}
+
+	l.Stop()
+	// the trigger goroutine returned, the second trigger finds the channel buffer full
+	stopped := make(chan struct{})
+	go func() {
+		l.TriggerFlush()
+		l.TriggerFlush()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Blocked triggering flushes after Stop")
+	}
+}
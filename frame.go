@@ -0,0 +1,85 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// SetLinePrefix to add prefix before each log that isn't a JSON object, e.g. a source tag for
+// a pipeline parsing plain text logs. It is added when the batch is built, not in the queue
+func SetLinePrefix(prefix []byte) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.linePrefix = append([]byte(nil), prefix...)
+		return nil
+	}
+}
+
+// SetLineSuffix to add suffix after each log that isn't a JSON object, see SetLinePrefix
+func SetLineSuffix(suffix []byte) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.lineSuffix = append([]byte(nil), suffix...)
+		return nil
+	}
+}
+
+func (l *LogzioSender) framesLines() bool {
+	return len(l.linePrefix) > 0 || len(l.lineSuffix) > 0
+}
+
+// frameLines adds the line prefix and suffix to the logs of an item that aren't JSON objects
+func (l *LogzioSender) frameLines(value []byte) []byte {
+	if !l.framesLines() {
+		return value
+	}
+	framed := make([]byte, 0, len(value)+len(l.linePrefix)+len(l.lineSuffix))
+	for len(value) > 0 {
+		line, rest := value, []byte(nil)
+		if i := bytes.IndexByte(value, '\n'); i >= 0 {
+			line, rest = value[:i], value[i:]
+		}
+		if len(line) > 0 && !isJSONObject(line) {
+			framed = append(framed, l.linePrefix...)
+			framed = append(framed, line...)
+			framed = append(framed, l.lineSuffix...)
+		} else {
+			framed = append(framed, line...)
+		}
+		if len(rest) > 0 {
+			framed = append(framed, '\n')
+			rest = rest[1:]
+		}
+		value = rest
+	}
+	return framed
+}
+
+// frameLogs frames the logs of an item ending at ends and returns the ends of the framed logs
+func (l *LogzioSender) frameLogs(value []byte, ends []int) ([]byte, []int) {
+	if !l.framesLines() || ends == nil {
+		return l.frameLines(value), ends
+	}
+	logs := l.splitLogs(value, ends)
+	for i, log := range logs {
+		logs[i] = l.frameLines(log)
+	}
+	return l.joinLogs(logs)
+}
+
+func isJSONObject(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_LinePrefixSuffix(t *testing.T) {
+	var (
+		body     atomic.Value
+		requests int32
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body.Store(string(b))
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetLinePrefix([]byte("[app] ")),
+		SetLineSuffix([]byte(" #end")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("plain"))
+	l.Send([]byte(`{"message":"json"}`))
+	l.Send([]byte("{not json"))
+	expected := "[app] plain #end\n{\"message\":\"json\"}\n[app] {not json #end\n"
+
+	// the requeued logs of the failed drain aren't framed twice
+	for i := 0; i < 2; i++ {
+		l.Drain()
+		if b, _ := body.Load().(string); b != expected {
+			t.Fatalf("drain %d: unexpected body %q", i, b)
+		}
+	}
+	if l.QueueCount() != 0 {
+		t.Fatalf("%d items queued", l.QueueCount())
+	}
+}
+
+func TestFrameLines(t *testing.T) {
+	l := &LogzioSender{linePrefix: []byte("<"), lineSuffix: []byte(">")}
+	cases := map[string]string{
+		"a":               "<a>",
+		"a\nb":            "<a>\n<b>",
+		"a\n\nb\n":        "<a>\n\n<b>\n",
+		`{"a":1}` + "\nb": `{"a":1}` + "\n<b>",
+		`  {"a":1}  `:     `  {"a":1}  `,
+		"[1,2]":           "<[1,2]>",
+		"":                "",
+	}
+	for value, expected := range cases {
+		if framed := string(l.frameLines([]byte(value))); framed != expected {
+			t.Errorf("%q framed %q != %q", value, framed, expected)
+		}
+	}
+	unframed := &LogzioSender{}
+	if framed := string(unframed.frameLines([]byte("a"))); framed != "a" {
+		t.Fatalf("Unexpected framing %q without prefix or suffix", framed)
+	}
+}
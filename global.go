@@ -0,0 +1,74 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotInitialized is returned by the package level functions before Init is called
+var ErrNotInitialized = errors.New("logzio: default sender is not initialized, call Init first")
+
+var (
+	defaultSender *LogzioSender
+	defaultMux    sync.RWMutex
+)
+
+// Init creates the package level default sender, replacing and stopping a previous one
+func Init(token string, options ...SenderOptionFunc) error {
+	defaultMux.Lock()
+	defer defaultMux.Unlock()
+	// stop the old sender first, it flushes its logs and releases its queue dir
+	if defaultSender != nil {
+		defaultSender.Stop()
+		defaultSender = nil
+	}
+	l, err := New(token, options...)
+	if err != nil {
+		return err
+	}
+	defaultSender = l
+	return nil
+}
+
+// Send the payload with the default sender
+func Send(payload []byte) error {
+	defaultMux.RLock()
+	defer defaultMux.RUnlock()
+	if defaultSender == nil {
+		return ErrNotInitialized
+	}
+	return defaultSender.Send(payload)
+}
+
+// Drain the default sender
+func Drain() {
+	defaultMux.RLock()
+	defer defaultMux.RUnlock()
+	if defaultSender != nil {
+		defaultSender.Drain()
+	}
+}
+
+// Stop the default sender, Init must be called again before sending
+func Stop() {
+	defaultMux.Lock()
+	defer defaultMux.Unlock()
+	if defaultSender != nil {
+		defaultSender.Stop()
+		defaultSender = nil
+	}
+}
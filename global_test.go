@@ -0,0 +1,69 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultSender_Lifecycle(t *testing.T) {
+	var mux sync.Mutex
+	tokens := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		tokens[r.URL.Query().Get("token")]++
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	if err := Send([]byte("blah")); err != ErrNotInitialized {
+		t.Fatalf("Expected ErrNotInitialized, got %v", err)
+	}
+	if err := Init("first-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send([]byte("blah")); err != nil {
+		t.Fatal(err)
+	}
+	// re-init flushes the first sender
+	if err := Init("second-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Send([]byte("blah"))
+		}()
+	}
+	wg.Wait()
+	Drain()
+	Stop()
+	if err := Send([]byte("blah")); err != ErrNotInitialized {
+		t.Fatalf("Expected ErrNotInitialized after Stop, got %v", err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if tokens["first-token"] != 1 || tokens["second-token"] != 1 {
+		t.Fatalf("Unexpected requests per token %v", tokens)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import "sync"
+
+// byteBudget is a weighted semaphore of the bytes held by the batches in flight, shared by the senders
+// created with the same SetMaxInFlightBytes option
+type byteBudget struct {
+	mux  sync.Mutex
+	free *sync.Cond
+	size uint64
+	used uint64
+}
+
+func newByteBudget(size uint64) *byteBudget {
+	b := &byteBudget{size: size}
+	b.free = sync.NewCond(&b.mux)
+	return b
+}
+
+// acquire waits until n bytes of the budget are free and returns the bytes acquired, at most the whole budget
+func (b *byteBudget) acquire(n uint64) uint64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if n > b.size {
+		n = b.size
+	}
+	for b.used+n > b.size {
+		b.free.Wait()
+	}
+	b.used += n
+	return n
+}
+
+func (b *byteBudget) release(n uint64) {
+	if n == 0 {
+		return
+	}
+	b.mux.Lock()
+	b.used -= n
+	b.mux.Unlock()
+	b.free.Broadcast()
+}
+
+// acquireInFlight reserves the bytes of the largest next batch and its compressed copy, it waits
+// while the batches of the senders sharing the bound hold them
+func (l *LogzioSender) acquireInFlight() uint64 {
+	if l.inFlight == nil {
+		return 0
+	}
+	return l.inFlight.acquire(l.inFlightBytes(l.batchSizeLimit()))
+}
+
+// fitInFlight gives back the reserved bytes a batch of size bytes doesn't use, a single log larger
+// than the bound keeps the whole reservation
+func (l *LogzioSender) fitInFlight(reserved uint64, size int) uint64 {
+	if used := l.inFlightBytes(size); l.inFlight != nil && used < reserved {
+		l.inFlight.release(reserved - used)
+		return used
+	}
+	return reserved
+}
+
+func (l *LogzioSender) releaseInFlight(reserved uint64) {
+	if l.inFlight != nil {
+		l.inFlight.release(reserved)
+	}
+}
+
+// inFlightBytes held by a batch of size bytes, with its compressed copy
+func (l *LogzioSender) inFlightBytes(size int) uint64 {
+	if l.compress {
+		return 2 * uint64(size)
+	}
+	return uint64(size)
+}
@@ -0,0 +1,171 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"sync"
+
+	"github.com/beeker1121/goque"
+)
+
+// genericQueue is the queue used by the sender, either the LevelDB disk queue or the in-memory queue
+type genericQueue interface {
+	Enqueue(value []byte) (*goque.Item, error)
+	Dequeue() (*goque.Item, error)
+	Peek() (*goque.Item, error)
+	PeekByOffset(offset uint64) (*goque.Item, error)
+	// Length is the number of items for the disk queue and the number of bytes for the in-memory queue
+	Length() uint64
+	Close()
+}
+
+// minShrinkCapacity is the capacity under which the items array is reused instead of reallocated smaller
+const minShrinkCapacity = 64
+
+// ConcurrentQueue goroutine safe in-memory FIFO queue.
+// Its memory grows with the queued items, nothing is allocated up front for the capacity of the sender
+type ConcurrentQueue struct {
+	lock   sync.Mutex
+	items  []*goque.Item // the queued items are items[head:]
+	head   int
+	nextID uint64
+	size   uint64
+	closed bool
+}
+
+// NewConcurrentQueue creates an empty in-memory queue
+func NewConcurrentQueue() *ConcurrentQueue {
+	return &ConcurrentQueue{nextID: 1}
+}
+
+// Enqueue adds an item to the end of the queue
+func (q *ConcurrentQueue) Enqueue(value []byte) (*goque.Item, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// copy like the disk queue does, callers such as Write may reuse the slice
+	v := make([]byte, len(value))
+	copy(v, value)
+	return q.enqueueOwned(v)
+}
+
+// EnqueueNoCopy adds value without copying it, the caller doesn't modify value afterwards
+func (q *ConcurrentQueue) EnqueueNoCopy(value []byte) (*goque.Item, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.enqueueOwned(value)
+}
+
+func (q *ConcurrentQueue) enqueueOwned(value []byte) (*goque.Item, error) {
+	if q.closed {
+		return nil, goque.ErrDBClosed
+	}
+	item := &goque.Item{ID: q.nextID, Value: value}
+	q.nextID++
+	q.items = append(q.items, item)
+	q.size += uint64(len(value))
+	return item, nil
+}
+
+// Dequeue removes the next item from the queue and returns it
+func (q *ConcurrentQueue) Dequeue() (*goque.Item, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, goque.ErrDBClosed
+	}
+	if q.head == len(q.items) {
+		return nil, goque.ErrEmpty
+	}
+	item := q.items[q.head]
+	q.items[q.head] = nil
+	q.head++
+	q.size -= uint64(len(item.Value))
+	q.compact()
+	return item, nil
+}
+
+// compact moves the queued items to the front once half of the array is dequeued, and reallocates
+// a smaller array when a burst left it mostly empty so the memory follows the occupancy
+func (q *ConcurrentQueue) compact() {
+	if q.head < len(q.items)/2 {
+		return
+	}
+	n := len(q.items) - q.head
+	if c := cap(q.items); c > minShrinkCapacity && n < c/4 {
+		items := make([]*goque.Item, n, 2*n)
+		copy(items, q.items[q.head:])
+		q.items = items
+	} else {
+		copy(q.items, q.items[q.head:])
+		for i := n; i < len(q.items); i++ {
+			q.items[i] = nil
+		}
+		q.items = q.items[:n]
+	}
+	q.head = 0
+}
+
+// Peek returns the next item without removing it
+func (q *ConcurrentQueue) Peek() (*goque.Item, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, goque.ErrDBClosed
+	}
+	if q.head == len(q.items) {
+		return nil, goque.ErrEmpty
+	}
+	return q.items[q.head], nil
+}
+
+// PeekByOffset returns the item at offset from the head without removing it
+func (q *ConcurrentQueue) PeekByOffset(offset uint64) (*goque.Item, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, goque.ErrDBClosed
+	}
+	if q.head == len(q.items) {
+		return nil, goque.ErrEmpty
+	}
+	if offset >= uint64(len(q.items)-q.head) {
+		return nil, goque.ErrOutOfBounds
+	}
+	return q.items[q.head+int(offset)], nil
+}
+
+// Length returns the number of bytes in the queue
+func (q *ConcurrentQueue) Length() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// Count returns the number of items in the queue
+func (q *ConcurrentQueue) Count() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return uint64(len(q.items) - q.head)
+}
+
+// Close drops the queued items, further operations return goque.ErrDBClosed
+func (q *ConcurrentQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.items = nil
+	q.head = 0
+	q.size = 0
+	q.closed = true
+}
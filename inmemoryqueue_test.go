@@ -0,0 +1,190 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beeker1121/goque"
+)
+
+func TestConcurrentQueue_FIFO(t *testing.T) {
+	q := NewConcurrentQueue()
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("bb"))
+	if q.Length() != 3 {
+		t.Fatalf("Unexpected length %d", q.Length())
+	}
+	item, _ := q.Peek()
+	if string(item.Value) != "a" || q.Length() != 3 {
+		t.Fatalf("Unexpected peek %s", string(item.Value))
+	}
+	for _, expected := range []string{"a", "bb"} {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(item.Value) != expected {
+			t.Fatalf("%s != %s", string(item.Value), expected)
+		}
+	}
+	if _, err := q.Dequeue(); err != goque.ErrEmpty {
+		t.Fatalf("Expected an empty queue %v", err)
+	}
+	if q.Length() != 0 {
+		t.Fatalf("Unexpected length %d", q.Length())
+	}
+}
+
+func TestConcurrentQueue_Close(t *testing.T) {
+	q := NewConcurrentQueue()
+	q.Enqueue([]byte("a"))
+	q.Close()
+	if _, err := q.Enqueue([]byte("a")); err != goque.ErrDBClosed {
+		t.Fatalf("Expected a closed queue %v", err)
+	}
+	if _, err := q.Dequeue(); err != goque.ErrDBClosed {
+		t.Fatalf("Expected a closed queue %v", err)
+	}
+}
+
+func TestConcurrentQueue_Count(t *testing.T) {
+	q := NewConcurrentQueue()
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("bb"))
+	if q.Count() != 2 {
+		t.Fatalf("Unexpected count %d", q.Count())
+	}
+	q.Dequeue()
+	if q.Count() != 1 || q.Length() != 2 {
+		t.Fatalf("Unexpected count %d and length %d", q.Count(), q.Length())
+	}
+}
+
+func TestConcurrentQueue_CountConcurrent(t *testing.T) {
+	const (
+		producers = 8
+		consumers = 4
+		perWorker = 1000
+	)
+	q := NewConcurrentQueue()
+	var (
+		wg       sync.WaitGroup
+		dequeued sync.Mutex
+		consumed uint64
+	)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				q.Enqueue([]byte("blah"))
+			}
+		}()
+	}
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if _, err := q.Dequeue(); err == nil {
+					dequeued.Lock()
+					consumed++
+					dequeued.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if q.Count() != producers*perWorker-consumed {
+		t.Fatalf("Count %d != %d enqueued - %d dequeued", q.Count(), producers*perWorker, consumed)
+	}
+	if q.Length() != q.Count()*4 {
+		t.Fatalf("Length %d inconsistent with count %d", q.Length(), q.Count())
+	}
+}
+
+func TestConcurrentQueue_MemoryFollowsOccupancy(t *testing.T) {
+	l, err := New("fake-token", SetInMemoryQueue(true), SetLogCountLimit(1000000), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	q := l.queue.(*ConcurrentQueue)
+	if cap(q.items) != 0 {
+		t.Fatalf("%d items allocated for an empty queue", cap(q.items))
+	}
+
+	for i := 0; i < 100000; i++ {
+		q.Enqueue([]byte("a"))
+	}
+	for i := 0; i < 99990; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Count() != 10 || cap(q.items) > 4*minShrinkCapacity {
+		t.Fatalf("%d items allocated for %d queued", cap(q.items), q.Count())
+	}
+	for i := 0; i < 10; i++ {
+		if item, err := q.Dequeue(); err != nil || item.ID != uint64(99991+i) {
+			t.Fatalf("Unexpected item %v after shrinking: %v", item, err)
+		}
+	}
+	if cap(q.items) > minShrinkCapacity {
+		t.Fatalf("%d items allocated for an empty queue", cap(q.items))
+	}
+}
+
+func TestLogzioSender_EstimatedCapacity(t *testing.T) {
+	cases := []struct {
+		capacity   uint64
+		countLimit int
+		avgLogSize int
+		expected   int
+	}{
+		{defaultMemoryCapacity, defaultLogCountLimit, 1024, 20 * 1024},
+		{defaultMemoryCapacity, defaultLogCountLimit, 10, defaultLogCountLimit},
+		{1000, 10, 100, 10},
+		{1000, 10, 101, 9},
+		{1000, 10, 2000, 0},
+		{1000, 10, 0, 10},
+	}
+	for _, c := range cases {
+		l, err := New("fake-token", SetInMemoryQueue(true), SetInMemoryCapacity(c.capacity), SetLogCountLimit(c.countLimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.EstimatedCapacity(c.avgLogSize); got != c.expected {
+			t.Errorf("%d bytes, %d logs, %d bytes per log: %d != %d", c.capacity, c.countLimit, c.avgLogSize, got, c.expected)
+		}
+		l.Stop()
+	}
+
+	l, err := New("fake-token", SetTempDirectory(filepath.Join(os.TempDir(), fmt.Sprintf("logzio-capacity-%d", time.Now().UnixNano()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+	if got := l.EstimatedCapacity(1024); got != -1 {
+		t.Fatalf("Unexpected disk queue capacity %d", got)
+	}
+}
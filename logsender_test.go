@@ -15,12 +15,39 @@
 package logzio
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/beeker1121/goque"
+	"github.com/shirou/gopsutil/disk"
 )
 
 func TestLogzioSender_Retries(t *testing.T) {
@@ -72,8 +99,9 @@ func TestLogzioSender_Send(t *testing.T) {
 	defer os.RemoveAll(l.dir)
 
 	l.Send([]byte("blah"))
-	l.Drain()
-	time.Sleep(200 * time.Millisecond)
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
 	sentMsg := string(sent[0:5])
 	if sentMsg != "blah\n" {
 		t.Fatalf("%s != %s ", sent, sentMsg)
@@ -83,6 +111,87 @@ func TestLogzioSender_Send(t *testing.T) {
 	}
 }
 
+func TestLogzioSender_DrainSyncWaitsForDrain(t *testing.T) {
+	var received int64
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case entered <- struct{}{}:
+			<-release
+		default:
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		atomic.AddInt64(&received, int64(bytes.Count(body, []byte("\n"))))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("first"))
+	go l.Drain()
+	<-entered
+	l.Send([]byte("second"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&received); n != 2 {
+		t.Fatalf("Expected both logs to be sent when DrainSync returns, got %d", n)
+	}
+}
+
+func TestLogzioSender_ArchiveWriter(t *testing.T) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var archive bytes.Buffer
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetCompress(true),
+		SetArchiveWriter(&archive),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("first"))
+	l.Send([]byte("second"))
+	if err := l.DrainSync(); err == nil {
+		t.Fatal("Expected the first drain to fail")
+	}
+	if archive.Len() != 0 {
+		t.Fatalf("Unexpected archive of a requeued batch %q", archive.String())
+	}
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := archive.String(); got != "first\nsecond\n" {
+		t.Fatalf("Unexpected archive %q", got)
+	}
+}
+
 func TestLogzioSender_DelayStart(t *testing.T) {
 	var sent = make([]byte, 1024)
 	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -104,7 +213,9 @@ func TestLogzioSender_DelayStart(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 	l.Drain()
 	ts.Start()
-	SetUrl(ts.URL)(l)
+	if err := l.UpdateURL(ts.URL); err != nil {
+		t.Fatal(err)
+	}
 	l.Drain()
 	time.Sleep(500 * time.Millisecond)
 	sentMsg := string(sent[0:5])
@@ -138,8 +249,9 @@ func TestLogzioSender_TmpDir(t *testing.T) {
 	defer os.RemoveAll(l.dir)
 
 	l.Send([]byte("blah"))
-	time.Sleep(200 * time.Millisecond)
-	l.Drain()
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
 	sentMsg := string(sent[0:5])
 	if len(sentMsg) != 5 {
 		t.Fatalf("Wrong len of msg %d", len(sentMsg))
@@ -171,8 +283,9 @@ func TestLogzioSender_Write(t *testing.T) {
 	defer os.RemoveAll(l.dir)
 
 	l.Write([]byte("blah"))
-	time.Sleep(200 * time.Millisecond)
-	l.Sync()
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
 	sentMsg := string(sent[0:5])
 	if len(sentMsg) != 5 {
 		t.Fatalf("Wrong len of msg %d", len(sentMsg))
@@ -217,11 +330,11 @@ func TestLogzioSender_RestoreQueue(t *testing.T) {
 	}
 
 	item, err := l.queue.Dequeue()
-	if string(item.Value) != "blah\n" {
+	if string(item.Value) != "blah" {
 		t.Fatalf("Unexpect item in the queue - %s", string(item.Value))
 	}
 	if item.ID != 2 {
-		t.Fatalf("Unexpect ID number - %s", string(item.ID))
+		t.Fatalf("Unexpect ID number - %d", item.ID)
 	}
 }
 
@@ -280,7 +393,7 @@ func TestLogzioSender_ThresholdLimit(t *testing.T) {
 	}
 	defer os.RemoveAll(l.dir)
 	<-time.After(l.checkDiskDuration + time.Second*2)
-	fmt.Printf("flag is %v", l.fullDisk)
+	fmt.Printf("flag is %v", l.fullDisk.Load())
 	l.Send([]byte("blah"))
 	item, err := l.queue.Dequeue()
 	if item != nil {
@@ -310,16 +423,2853 @@ func TestLogzioSender_ThresholdLimitWithoutCheck(t *testing.T) {
 
 }
 
-func BenchmarkLogzioSender(b *testing.B) {
-	b.ReportAllocs()
+func TestLogzioSender_DrainWithResult(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
-	l, _ := New("fake-token", SetUrl(ts.URL), SetDrainDuration(time.Hour))
 	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl(ts.URL),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+
+	l.Send([]byte("a"))
+	l.Send([]byte("bb"))
+	l.Send([]byte("ccc"))
+	res := l.DrainWithResult()
+	// "a\nbb\nccc\n"
+	expected := DrainResult{SentLogs: 3, SentBytes: 9}
+	if res != expected {
+		t.Fatalf("%+v != %+v", res, expected)
+	}
+	res = l.DrainWithResult()
+	if res != (DrainResult{}) {
+		t.Fatalf("Unexpected result for an empty queue %+v", res)
+	}
+}
+
+func TestLogzioSender_DrainWithResultMultipleBatches(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
 	defer l.Stop()
-	msg := []byte("test")
-	for i := 0; i < b.N; i++ {
-		l.Send(msg)
+
+	// two logs that do not fit in one batch
+	big := bytes.Repeat([]byte("a"), maxSize/2+1)
+	l.Send(big)
+	l.Send(big)
+	res := l.DrainWithResult()
+	expected := DrainResult{SentLogs: 2, SentBytes: 2 * (len(big) + 1)}
+	if res != expected {
+		t.Fatalf("%+v != %+v", res, expected)
+	}
+	if requests != 2 {
+		t.Fatalf("Expected 2 requests, got %d", requests)
+	}
+}
+
+func TestLogzioSender_DrainWithResultFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+
+	l.Send([]byte("blah"))
+	res := l.DrainWithResult()
+	// bad request is not retried nor requeued
+	expected := DrainResult{FailedBatches: 1, StatusCode: http.StatusBadRequest}
+	if res != expected {
+		t.Fatalf("%+v != %+v", res, expected)
+	}
+}
+
+func TestLogzioSender_InMemoryQueue(t *testing.T) {
+	var sent = make([]byte, 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		r.Body.Read(sent)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	l.Send([]byte("blah"))
+	l.Drain()
+	sentMsg := string(sent[0:5])
+	if sentMsg != "blah\n" {
+		t.Fatalf("%s != %s ", string(sent), sentMsg)
+	}
+}
+
+func TestLogzioSender_InMemoryCapacityLimit(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetInMemoryCapacity(10),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("12345"))
+	l.Send([]byte("67890"))
+	// 10 + 1 crosses the capacity
+	l.Send([]byte("1"))
+	if l.queue.Length() != 10 {
+		t.Fatalf("Unexpected queue size %d", l.queue.Length())
+	}
+}
+
+func TestLogzioSender_InMemoryCapacityExactFit(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetInMemoryCapacity(10),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("123"))
+	// exactly the remaining capacity
+	if _, err := l.Write([]byte("4567890")); err != nil {
+		t.Fatalf("Expected a log of the remaining capacity to fit, got %v", err)
+	}
+	if l.queue.Length() != 10 || l.QueueCount() != 2 {
+		t.Fatalf("Unexpected queue size %d with %d logs", l.queue.Length(), l.QueueCount())
+	}
+}
+
+func TestLogzioSender_InMemoryCountLimit(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(2),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	l.Send([]byte("blah"))
+	l.Send([]byte("blah"))
+	if count := l.QueueCount(); count != 2 {
+		t.Fatalf("Unexpected number of items in the queue %d", count)
+	}
+}
+
+func TestLogzioSender_DropLogInterval(t *testing.T) {
+	var debug bytes.Buffer
+	c := newFakeClock()
+	l, err := New(
+		"fake-token",
+		SetDebug(&debug),
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(1),
+		SetDrainDuration(time.Minute*10),
+		SetDropLogInterval(time.Second),
+		SetRetryPolicy(noRetryPolicy{}),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 0; i < 101; i++ {
+		l.Send([]byte("blah"))
+	}
+	if n := strings.Count(debug.String(), "Dropping logs"); n != 1 {
+		t.Fatalf("Expected a single drop message, got %d:\n%s", n, debug.String())
+	}
+	c.Advance(time.Second)
+	l.Send([]byte("blah"))
+	if n := strings.Count(debug.String(), "Dropping logs"); n != 2 {
+		t.Fatalf("Expected a second drop message, got %d:\n%s", n, debug.String())
+	}
+	if !strings.Contains(debug.String(), ", 99 more drops since the previous message") {
+		t.Fatalf("Missing the number of suppressed drops:\n%s", debug.String())
+	}
+	if dropped := l.Metrics().DroppedLogs; dropped != 101 {
+		t.Fatalf("Expected 101 dropped logs, got %d", dropped)
+	}
+	if _, err := New("fake-token", SetDropLogInterval(-time.Second)); err == nil {
+		t.Fatal("Expected an error for a negative drop log interval")
+	}
+}
+
+// notWritableDir returns a queue dir that can't be created, even when running as root
+func notWritableDir(t *testing.T) (string, func()) {
+	f, err := ioutil.TempFile("", "logzio-not-a-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return filepath.Join(f.Name(), "queue"), func() { os.Remove(f.Name()) }
+}
+
+func TestLogzioSender_NotWritableDir(t *testing.T) {
+	dir, cleanup := notWritableDir(t)
+	defer cleanup()
+	_, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetTempDirectory(dir),
+	)
+	if err == nil {
+		t.Fatal("Expected an error opening the disk queue")
+	}
+	if !strings.HasPrefix(err.Error(), fmt.Sprintf("failed to open disk queue at %s: ", dir)) {
+		t.Fatalf("Unexpected error %s", err)
+	}
+}
+
+func TestLogzioSender_NotWritableDirFallback(t *testing.T) {
+	dir, cleanup := notWritableDir(t)
+	defer cleanup()
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl("http://localhost:12345"),
+		SetTempDirectory(dir),
+		SetFallbackToMemoryOnDiskError(true),
+		SetDrainDuration(time.Minute*10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.inMemoryQueue {
+		t.Fatal("Expected to fall back to the in-memory queue")
+	}
+	l.Send([]byte("blah"))
+	item, err := l.queue.Dequeue()
+	if err != nil || string(item.Value) != "blah" {
+		t.Fatalf("Unexpected item in the queue %v %v", item, err)
+	}
+}
+
+func TestLogzioSender_PeekQueue(t *testing.T) {
+	for _, inMemory := range []bool{false, true} {
+		l, err := New(
+			"fake-token",
+			SetUrl("http://localhost:12345"),
+			SetInMemoryQueue(inMemory),
+			SetDrainDuration(time.Minute*10),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("a"))
+		l.Send([]byte("b"))
+		l.Send([]byte("c"))
+
+		peeked := l.PeekQueue(2)
+		if len(peeked) != 2 || string(peeked[0]) != "a" || string(peeked[1]) != "b" {
+			t.Fatalf("Unexpected peeked items %q (in memory %v)", peeked, inMemory)
+		}
+		if peeked = l.PeekQueue(10); len(peeked) != 3 {
+			t.Fatalf("Unexpected peeked items %q (in memory %v)", peeked, inMemory)
+		}
+		// peek does not remove the items
+		item, err := l.queue.Dequeue()
+		if err != nil || string(item.Value) != "a" {
+			t.Fatalf("Unexpected item in the queue %v %v (in memory %v)", item, err, inMemory)
+		}
+		l.queue.Close()
+		os.RemoveAll(l.dir)
+	}
+}
+
+func TestClassifyTransportError(t *testing.T) {
+	dial := func(err error) error {
+		return &url.Error{Op: "Post", URL: "http://listener", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	cases := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"connection refused", dial(syscall.ECONNREFUSED), httpError},
+		{"timeout", dial(&net.DNSError{Err: "i/o timeout", Name: "listener", IsTimeout: true}), httpError},
+		{"dns", dial(&net.DNSError{Err: "no such host", Name: "listener"}), dnsError},
+		{"unknown authority", &url.Error{Op: "Post", URL: "https://listener", Err: x509.UnknownAuthorityError{}}, tlsError},
+		{"hostname", &url.Error{Op: "Post", URL: "https://listener", Err: x509.HostnameError{Host: "listener"}}, tlsError},
+	}
+	for _, c := range cases {
+		if code := classifyTransportError(c.err); code != c.expected {
+			t.Errorf("%s: %d != %d", c.name, code, c.expected)
+		}
+	}
+}
+
+func TestLogzioSender_NonRetryableTransportErrors(t *testing.T) {
+	for dialErr, statusCode := range map[error]int{
+		&net.DNSError{Err: "no such host", Name: "listener"}: StatusDNSError,
+		x509.UnknownAuthorityError{}:                         StatusTLSError,
+	} {
+		l, err := New(
+			"fake-token",
+			SetDebug(os.Stderr),
+			SetUrl("http://listener"),
+			SetInMemoryQueue(true),
+			SetDrainDuration(time.Minute*10),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dials := 0
+		l.httpTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return nil, dialErr
+		}
+		l.Send([]byte("blah"))
+		start := time.Now()
+		res := l.DrainWithResult()
+		// no backoff, the batch is requeued for the next drain
+		if time.Since(start) >= sendSleepingBackoff {
+			t.Fatalf("Unexpected retries for %v", dialErr)
+		}
+		if dials != 1 {
+			t.Fatalf("Expected a single attempt for %v, got %d", dialErr, dials)
+		}
+		if res != (DrainResult{FailedBatches: 1, Requeued: 1, StatusCode: statusCode}) {
+			t.Fatalf("Unexpected result %+v for %v", res, dialErr)
+		}
+		l.Stop()
+	}
+}
+
+func TestLogzioSender_Proxy(t *testing.T) {
+	var (
+		proxyAuth string
+		target    string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyAuth = r.Header.Get("Proxy-Authorization")
+		target = r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	proxyURL, _ := url.Parse(proxy.URL)
+	for _, options := range [][]SenderOptionFunc{
+		{SetProxy(proxy.URL), SetProxyBasicAuth("user", "pass")},
+		{SetProxyBasicAuth("user", "pass"), SetProxy(proxy.URL)},
+		{SetProxy("http://user:pass@" + proxyURL.Host)},
+	} {
+		proxyAuth, target = "", ""
+		options = append(options, SetUrl("http://listener.example"), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+		l, err := New("fake-token", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("blah"))
+		res := l.DrainWithResult()
+		l.Stop()
+		if res.SentLogs != 1 {
+			t.Fatalf("Expected the log to be sent through the proxy %+v", res)
+		}
+		if target != "http://listener.example/?token=fake-token" {
+			t.Fatalf("Unexpected proxied url %s", target)
+		}
+		if proxyAuth != expectedAuth {
+			t.Fatalf("%s != %s", proxyAuth, expectedAuth)
+		}
+	}
+}
+
+func TestLogzioSender_InvalidProxy(t *testing.T) {
+	if _, err := New("fake-token", SetProxy("listener.example")); err == nil {
+		t.Fatal("Expected an error for a proxy url without a scheme")
+	}
+}
+
+func TestLogzioSender_MaxBufferCapacity(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetMaxBufferCapacity(1024),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	l.Send(bytes.Repeat([]byte("a"), 1024*1024))
+	if res := l.DrainWithResult(); res.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if l.buf.Cap() > 1024 {
+		t.Fatalf("Buffer capacity %d was not bounded after a large drain", l.buf.Cap())
+	}
+	for i := 0; i < 10; i++ {
+		l.Send([]byte("blah"))
+	}
+	if res := l.DrainWithResult(); res.SentLogs != 10 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if l.buf.Cap() > 1024 {
+		t.Fatalf("Buffer capacity %d was not bounded after a small drain", l.buf.Cap())
+	}
+}
+
+func TestLogzioSender_QueueStateCallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var states []bool
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(2),
+		SetQueueStateCallback(func(full bool) {
+			states = append(states, full)
+		}),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	for i := 0; i < 10; i++ {
+		l.Send([]byte("blah"))
+	}
+	l.Drain()
+	for i := 0; i < 2; i++ {
+		l.Send([]byte("blah"))
+	}
+	if len(states) != 2 || !states[0] || states[1] {
+		t.Fatalf("Unexpected queue state callbacks %v", states)
+	}
+}
+
+func TestLogzioSender_StartupJitter(t *testing.T) {
+	drained := make(chan time.Time, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case drained <- time.Now():
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	drainDuration := 100 * time.Millisecond
+	jitter := 500 * time.Millisecond
+	start := time.Now()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(drainDuration),
+		SetStartupJitter(jitter),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if l.startupDelay < 0 || l.startupDelay >= jitter {
+		t.Fatalf("Startup delay %v out of [0, %v)", l.startupDelay, jitter)
+	}
+	l.Send([]byte("blah"))
+	select {
+	case at := <-drained:
+		if elapsed := at.Sub(start); elapsed < drainDuration+l.startupDelay {
+			t.Fatalf("First drain after %v, expected at least %v", elapsed, drainDuration+l.startupDelay)
+		}
+	case <-time.After(drainDuration + jitter + time.Second):
+		t.Fatal("First drain did not happen")
+	}
+}
+
+func TestLogzioSender_UpdateURL(t *testing.T) {
+	var mux sync.Mutex
+	hits := map[string]int{}
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			hits[name]++
+			mux.Unlock()
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	first := httptest.NewServer(handler("first"))
+	defer first.Close()
+	second := httptest.NewServer(handler("second"))
+	defer second.Close()
+
+	l, err := New(
+		"fake-token",
+		SetUrl(first.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if err := l.UpdateURL("not a url"); err == nil {
+		t.Fatal("Expected an error for an invalid url")
+	}
+
+	sent := 0
+	for i := 0; i < 100; i++ {
+		l.Send([]byte("blah"))
+		sent++
+		if i%2 == 0 {
+			l.UpdateURL(second.URL)
+		} else {
+			l.UpdateURL(first.URL)
+		}
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.UpdateURL(second.URL)
+	l.Drain()
+	time.Sleep(100 * time.Millisecond)
+	l.Drain()
+
+	mux.Lock()
+	defer mux.Unlock()
+	if hits["first"]+hits["second"] == 0 || hits["second"] == 0 {
+		t.Fatalf("Unexpected requests %v", hits)
+	}
+	if l.url.Load() != second.URL+"/?token=fake-token" {
+		t.Fatalf("Unexpected url %s", l.url.Load())
+	}
+}
+
+func TestLogzioSender_VerifyOnStart(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	l, err := New("fake-token", SetUrl(ok.URL), SetInMemoryQueue(true), SetVerifyOnStart(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Stop()
+
+	_, err = New("fake-token", SetUrl(unauthorized.URL), SetInMemoryQueue(true), SetVerifyOnStart(true))
+	if err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized, got %v", err)
+	}
+
+	_, err = New("fake-token", SetUrl(down.URL), SetInMemoryQueue(true), SetVerifyOnStart(true))
+	if _, unreachable := err.(*UnreachableError); !unreachable {
+		t.Fatalf("Expected an UnreachableError, got %v", err)
+	}
+}
+
+func TestLogzioSender_WriteSplitLines(t *testing.T) {
+	cases := []struct {
+		split     bool
+		keepEmpty bool
+		writes    []string
+		expected  []string
+	}{
+		{false, false, []string{"a\nb"}, []string{"a\nb"}},
+		{true, false, []string{"a\nb\n"}, []string{"a", "b"}},
+		{true, false, []string{"a\r\n\n\nb", "c"}, []string{"a", "b", "c"}},
+		{true, false, []string{"\n", ""}, nil},
+		{true, false, []string{"a\n \t\nb\n"}, []string{"a", "b"}},
+		{true, true, []string{"a\n\n \nb\n"}, []string{"a", "", " ", "b"}},
+	}
+	for _, c := range cases {
+		l, err := New(
+			"fake-token",
+			SetUrl("http://localhost:12345"),
+			SetInMemoryQueue(true),
+			SetSplitLines(c.split),
+			SetSkipEmpty(!c.keepEmpty),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range c.writes {
+			n, err := l.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("Unexpected write result %d %v for %q", n, err, w)
+			}
+		}
+		var queued []string
+		for _, payload := range l.PeekQueue(10) {
+			queued = append(queued, string(payload))
+		}
+		if fmt.Sprint(queued) != fmt.Sprint(c.expected) || len(queued) != len(c.expected) {
+			t.Fatalf("%q != %q for %q", queued, c.expected, c.writes)
+		}
+		l.queue.Close()
+	}
+}
+
+func TestLogzioSender_WriteQueueFull(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(2),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.queue.Close()
+	l.Send([]byte("a"))
+	l.Send([]byte("b"))
+
+	n, err := io.Copy(l, strings.NewReader("blah"))
+	if err != ErrQueueFull || n != 0 {
+		t.Fatalf("Expected ErrQueueFull from io.Copy, got %d %v", n, err)
+	}
+	// Send keeps dropping silently
+	if err := l.Send([]byte("blah")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogzioSender_WriteSplitLinesQueueFull(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetLogCountLimit(2),
+		SetSplitLines(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.queue.Close()
+	n, err := l.Write([]byte("a\nb\nc\n"))
+	if err != ErrQueueFull || n != 4 {
+		t.Fatalf("Expected a short write of 4 bytes and ErrQueueFull, got %d %v", n, err)
+	}
+}
+
+func TestLogzioSender_FullPolicy(t *testing.T) {
+	cases := []struct {
+		policy   FullPolicy
+		options  []SenderOptionFunc
+		expected []string
+	}{
+		{DropNewest, []SenderOptionFunc{SetLogCountLimit(2)}, []string{"a", "b"}},
+		{DropOldest, []SenderOptionFunc{SetLogCountLimit(2)}, []string{"b", "c"}},
+		{DropNewest, []SenderOptionFunc{SetInMemoryCapacity(2)}, []string{"a", "b"}},
+		{DropOldest, []SenderOptionFunc{SetInMemoryCapacity(2)}, []string{"b", "c"}},
+	}
+	for _, c := range cases {
+		options := append(c.options, SetUrl("http://localhost:12345"), SetInMemoryQueue(true),
+			SetFullPolicy(c.policy), SetDrainDuration(time.Hour))
+		l, err := New("fake-token", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []string{"a", "b", "c"} {
+			l.Send([]byte(msg))
+		}
+		var queued []string
+		for _, payload := range l.PeekQueue(10) {
+			queued = append(queued, string(payload))
+		}
+		if fmt.Sprint(queued) != fmt.Sprint(c.expected) {
+			t.Fatalf("%q != %q for policy %d", queued, c.expected, c.policy)
+		}
+		l.queue.Close()
+	}
+}
+
+func TestLogzioSender_FullPolicyDropOldestDisk(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetFullPolicy(DropOldest),
+		SetCheckDiskSpace(false),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.queue.Close()
+	l.Send([]byte("a"))
+	l.Send([]byte("b"))
+	l.fullDisk.Store(true)
+	l.Send([]byte("c"))
+	peeked := l.PeekQueue(10)
+	if len(peeked) != 2 || string(peeked[0]) != "b" || string(peeked[1]) != "c" {
+		t.Fatalf("Unexpected queue %q", peeked)
+	}
+}
+
+func TestLogzioSender_InvalidFullPolicy(t *testing.T) {
+	if _, err := New("fake-token", SetFullPolicy(FullPolicy(42))); err == nil {
+		t.Fatal("Expected an error for an unknown full policy")
+	}
+}
+
+func TestLogzioSender_MaxRequestBytes(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		var bodies [][]byte
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		maxRequestBytes := 20
+		if compress {
+			// room for the gzip header and footer
+			maxRequestBytes = 60
+		}
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetInMemoryQueue(true),
+			SetCompress(compress),
+			SetMaxRequestBytes(maxRequestBytes),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected bytes.Buffer
+		for i := 0; i < 20; i++ {
+			msg := fmt.Sprintf("log-%02d", i)
+			expected.WriteString(msg + "\n")
+			l.Send([]byte(msg))
+		}
+		// never fits in a request, even compressed
+		random := make([]byte, 512)
+		rand.New(rand.NewSource(1)).Read(random)
+		l.Send([]byte(hex.EncodeToString(random)))
+		res := l.DrainWithResult()
+		l.Stop()
+		ts.Close()
+
+		if res.SentLogs != 20 || res.FailedBatches != 0 {
+			t.Fatalf("Unexpected result %+v (compress %v)", res, compress)
+		}
+		if len(bodies) < 2 {
+			t.Fatalf("Expected several requests, got %d (compress %v)", len(bodies), compress)
+		}
+		var received bytes.Buffer
+		for _, body := range bodies {
+			if len(body) > maxRequestBytes {
+				t.Fatalf("Request of %d bytes larger than %d (compress %v)", len(body), maxRequestBytes, compress)
+			}
+			if compress {
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ = ioutil.ReadAll(gz)
+			}
+			if !bytes.HasSuffix(body, []byte("\n")) {
+				t.Fatalf("Request with a partial log %q", body)
+			}
+			received.Write(body)
+		}
+		if received.String() != expected.String() {
+			t.Fatalf("%q != %q (compress %v)", received.String(), expected.String(), compress)
+		}
+	}
+}
+
+func TestLogzioSender_ContentType(t *testing.T) {
+	contentType := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType <- r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetContentType("application/x-ndjson; charset=utf-8"),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte(`{"message":"blah"}`))
+	l.Drain()
+	if got := <-contentType; got != "application/x-ndjson; charset=utf-8" {
+		t.Fatalf("Unexpected content type %s", got)
+	}
+
+	for _, invalid := range []string{"", "json", "application/json; =x"} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), SetContentType(invalid)); err == nil {
+			t.Fatalf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestLogzioSender_HTTPMethod(t *testing.T) {
+	methods := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetHTTPMethod("put"),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	l.Drain()
+	if err := l.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-methods; got != http.MethodPut {
+			t.Fatalf("Unexpected method %s", got)
+		}
+	}
+
+	for _, invalid := range []string{"", "GET", "DELETE"} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), SetHTTPMethod(invalid)); err == nil {
+			t.Fatalf("expected an error for %q", invalid)
+		}
+	}
+}
+
+type traceKey struct{}
+
+func TestLogzioSender_RequestDecorator(t *testing.T) {
+	headers := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRequestDecorator(func(req *http.Request) {
+			if trace, ok := req.Context().Value(traceKey{}).(string); ok {
+				req.Header.Set("traceparent", trace)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	const trace = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	l.Send([]byte("blah"))
+	ctx := context.WithValue(context.Background(), traceKey{}, trace)
+	if res := l.DrainContext(ctx); res.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if got := <-headers; got != trace {
+		t.Fatalf("Unexpected traceparent %q", got)
+	}
+
+	// a done context doesn't send
+	l.Send([]byte("blah"))
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if res := l.DrainContext(canceled); res != (DrainResult{}) {
+		t.Fatalf("Unexpected result for a canceled context %+v", res)
+	}
+	if l.QueueCount() != 1 {
+		t.Fatalf("%d logs queued after a canceled drain", l.QueueCount())
+	}
+}
+
+func TestLogzioSender_RequestInterceptor(t *testing.T) {
+	var requests, verified int64
+	key := []byte("secret")
+	sign := func(body []byte) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Signature") == sign(body) {
+			atomic.AddInt64(&verified, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var fail atomic.Value
+	fail.Store(true)
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+		SetRequestInterceptor(func(req *http.Request) error {
+			if fail.Load().(bool) {
+				return errors.New("no credentials")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			b, _ := ioutil.ReadAll(body)
+			req.Header.Set("X-Signature", sign(b))
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	// an interceptor error fails the request without sending it
+	if res := l.DrainWithResult(); res.FailedBatches != 1 || res.Requeued != 1 || res.StatusCode != httpError {
+		t.Fatalf("Unexpected result %+v with a failing interceptor", res)
+	}
+	if n := atomic.LoadInt64(&requests); n != 0 {
+		t.Fatalf("%d requests sent despite the interceptor error", n)
+	}
+	fail.Store(false)
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&requests) != 1 || atomic.LoadInt64(&verified) != 1 {
+		t.Fatalf("Expected a signed request, got %d requests and %d verified", requests, verified)
+	}
+}
+
+func TestLogzioSender_ResponseInterceptor(t *testing.T) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(100-n, 10))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var quotas []string
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(zeroWaitRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+		SetResponseInterceptor(func(resp *http.Response) error {
+			quotas = append(quotas, resp.Header.Get("X-Quota-Remaining"))
+			if len(quotas) == 1 {
+				return errors.New("retry")
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	// the interceptor error retries the request
+	if res := l.DrainWithResult(); res.SentLogs != 1 || res.FailedBatches != 0 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if len(quotas) != 2 || quotas[0] != "99" || quotas[1] != "98" {
+		t.Fatalf("Unexpected quota headers %v", quotas)
+	}
+}
+
+func TestLogzioSender_Name(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	debug := &bytes.Buffer{}
+	l, err := New(
+		"fake-token",
+		SetName("tenant-a"),
+		SetDebug(debug),
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	l.Drain()
+	l.Stop()
+	lines := strings.Split(strings.TrimSuffix(debug.String(), "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Unexpected debug output %q", debug.String())
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[tenant-a] ") {
+			t.Fatalf("Debug line without the sender name %q", line)
+		}
+	}
+
+	structured := &bytes.Buffer{}
+	l, err = New("fake-token", SetName("tenant-b"), SetDebug(structured), SetStructuredDebug(true), SetInMemoryQueue(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.infoLog("logziosender.go: hello\n")
+	if !strings.Contains(structured.String(), `{"sender":"tenant-b","level":"info","msg":"hello"`) {
+		t.Fatalf("Unexpected structured debug output %q", structured.String())
+	}
+}
+
+func TestLogzioSender_StructuredDebug(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	debug := &bytes.Buffer{}
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDebug(debug),
+		SetStructuredDebug(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	l.Drain()
+	l.Stop()
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(debug.String()), "\n") {
+		var entry struct {
+			Level  string                 `json:"level"`
+			Msg    string                 `json:"msg"`
+			Fields map[string]interface{} `json:"fields"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid debug line %q: %s", line, err)
+		}
+		if entry.Level == "" || entry.Fields == nil || strings.HasSuffix(entry.Msg, "\n") {
+			t.Fatalf("Unexpected debug line %q", line)
+		}
+		if entry.Msg == "request to the listener" && entry.Level == "debug" {
+			if _, err := time.ParseDuration(entry.Fields["latency"].(string)); err != nil {
+				t.Fatalf("Unexpected latency in %q", line)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("request event not found in %s", debug.String())
+	}
+}
+
+func TestLogzioSender_DebugLevel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	debug := &bytes.Buffer{}
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDebug(debug),
+		SetDebugLevel(DebugLevelWarn),
+		SetMaxRequestBytes(16),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	l.Send([]byte("larger than the max request bytes"))
+	l.Drain()
+	l.Stop()
+
+	out := debug.String()
+	if strings.Contains(out, "Adding item") || strings.Contains(out, "Setting url") {
+		t.Fatalf("debug and info messages written at warn level: %s", out)
+	}
+	if !strings.Contains(out, "dropping log with size") {
+		t.Fatalf("error missing at warn level: %s", out)
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetDebugLevel(DebugLevelDebug+1)); err == nil {
+		t.Fatal("expected an error for an invalid level")
+	}
+}
+
+func TestLogzioSender_DebugTransportAndHTTPErrors(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	downURL := down.URL
+	down.Close()
+	debug := &bytes.Buffer{}
+	l, err := New(
+		"fake-token",
+		SetUrl(downURL),
+		SetInMemoryQueue(true),
+		SetDebug(debug),
+		SetDebugLevel(DebugLevelWarn),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	l.Drain()
+	out := debug.String()
+	if !strings.Contains(out, "Transport error (connection), no response sending logs to "+downURL) ||
+		!strings.Contains(out, "connection refused") {
+		t.Fatalf("transport error missing from the debug log: %s", out)
+	}
+	if strings.Contains(out, "fake-token") {
+		t.Fatalf("token in the debug log: %s", out)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("overloaded"))
+	}))
+	defer ts.Close()
+	l.UpdateURL(ts.URL)
+	debug.Reset()
+	l.Drain()
+	l.Stop()
+	out = debug.String()
+	if !strings.Contains(out, "HTTP error 503 sending logs to "+ts.URL) || !strings.Contains(out, "overloaded") {
+		t.Fatalf("HTTP error missing from the debug log: %s", out)
+	}
+	if strings.Contains(out, "Transport error") {
+		t.Fatalf("HTTP error logged as a transport error: %s", out)
+	}
+	if strings.Contains(out, "fake-token") {
+		t.Fatalf("token in the debug log: %s", out)
+	}
+}
+
+func TestRedactedURL(t *testing.T) {
+	cases := map[string]string{
+		"https://listener.logz.io:8071/?token=fake-token":         "https://listener.logz.io:8071/",
+		"https://listener.logz.io:8071/?token=fake-token&type=go": "https://listener.logz.io:8071/?type=go",
+		"http://localhost:12345/?type=go":                         "http://localhost:12345/?type=go",
+	}
+	for listenerURL, expected := range cases {
+		if redacted := redactedURL(listenerURL); redacted != expected {
+			t.Fatalf("%q != %q for %q", redacted, expected, listenerURL)
+		}
+	}
+}
+
+func TestLogzioSender_MaxBatchCount(t *testing.T) {
+	var mux sync.Mutex
+	var requests []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		requests = append(requests, strings.Count(string(body), "\n"))
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetMaxBatchCount(3),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 0; i < 7; i++ {
+		l.Send([]byte("x"))
+	}
+	if res := l.DrainWithResult(); res.SentLogs != 7 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if fmt.Sprint(requests) != "[3 3 1]" {
+		t.Fatalf("Unexpected logs per request %v", requests)
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMaxBatchCount(-1)); err == nil {
+		t.Fatal("expected an error for a negative count")
+	}
+}
+
+func TestLogzioSender_PauseResume(t *testing.T) {
+	sent := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sent <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Pause()
+	l.Send([]byte("first"))
+	l.Send([]byte("second"))
+	time.Sleep(100 * time.Millisecond)
+	l.Drain()
+	if len(sent) != 0 || l.QueueCount() != 2 {
+		t.Fatalf("sent while paused, %d requests and %d queued logs", len(sent), l.QueueCount())
+	}
+
+	l.Resume()
+	select {
+	case body := <-sent:
+		if body != "first\nsecond\n" {
+			t.Fatalf("Unexpected body %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued logs not sent after resume")
+	}
+}
+
+func TestLogzioSender_MaxInFlightBytes(t *testing.T) {
+	var mux sync.Mutex
+	var sizes []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		sizes = append(sizes, len(body))
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetMaxInFlightBytes(100),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 0; i < 10; i++ {
+		l.Send([]byte(strings.Repeat("x", 20)))
+	}
+	l.Send([]byte(strings.Repeat("y", 150)))
+	if res := l.DrainWithResult(); res.SentLogs != 11 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	// 4 logs of 21 bytes fit, the larger log is sent alone
+	if fmt.Sprint(sizes) != "[84 84 42 151]" {
+		t.Fatalf("Unexpected request sizes %v", sizes)
+	}
+
+	l.compress = true
+	if limit := l.batchSizeLimit(); limit != 50 {
+		t.Fatalf("Unexpected batch size limit %d with compression", limit)
+	}
+}
+
+func TestLogzioSender_SharedMaxInFlightBytes(t *testing.T) {
+	requests := make(chan string, 10)
+	unblock := make(chan struct{})
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- string(body)
+		select {
+		case <-unblock:
+		case <-done:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(done)
+	inFlight := SetMaxInFlightBytes(100)
+	var senders []*LogzioSender
+	for i := 0; i < 2; i++ {
+		l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour), inFlight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Stop()
+		l.Send([]byte(strings.Repeat(fmt.Sprint(i), 80)))
+		senders = append(senders, l)
+	}
+	var wg sync.WaitGroup
+	for _, l := range senders {
+		wg.Add(1)
+		go func(l *LogzioSender) {
+			defer wg.Done()
+			if res := l.DrainWithResult(); res.SentLogs != 1 {
+				t.Errorf("Unexpected result %+v", res)
+			}
+		}(l)
+	}
+	<-requests
+	// the batch being sent holds 81 of the 100 bytes, the other batch waits for them
+	select {
+	case body := <-requests:
+		t.Fatalf("Unexpected concurrent request %q", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unblock <- struct{}{}
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The second batch was not sent")
+	}
+	unblock <- struct{}{}
+	wg.Wait()
+}
+
+func TestLogzioSender_Warmup(t *testing.T) {
+	var connections, idle int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&connections, 1)
+		case http.StateIdle:
+			atomic.AddInt64(&idle, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetWarmup(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	// the warm connection is idle once the warmup request is answered
+	for start := time.Now(); atomic.LoadInt64(&idle) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected a warmup request before the first Send")
+		}
+	}
+	if n := atomic.LoadInt64(&connections); n != 1 {
+		t.Fatalf("Expected a connection before the first Send, got %d", n)
+	}
+	l.Send([]byte("blah"))
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&connections); n != 1 {
+		t.Fatalf("Expected the drain to reuse the warm connection, got %d connections", n)
+	}
+}
+
+func TestLogzioSender_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logzio-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "listener.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body, token atomic.Value
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body.Store(string(b))
+		token.Store(r.URL.Query().Get("token"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Listener.Close()
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl("http://logzio-agent"),
+		SetUnixSocket(socket),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := body.Load().(string); got != "blah\n" {
+		t.Fatalf("Unexpected body %q", got)
+	}
+	if got, _ := token.Load().(string); got != "fake-token" {
+		t.Fatalf("Unexpected token %q", got)
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetUnixSocket("")); err == nil {
+		t.Fatal("Expected an error for an empty unix socket")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetUnixSocket(socket), SetSharedTransport(&http.Transport{})); err == nil {
+		t.Fatal("Expected an error for a unix socket with a shared transport")
+	}
+}
+
+func TestLogzioSender_MinTLSVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	ts.StartTLS()
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	newSender := func(options ...SenderOptionFunc) *LogzioSender {
+		l, err := New("fake-token", append([]SenderOptionFunc{SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour)}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.httpTransport.TLSClientConfig.RootCAs = roots
+		return l
+	}
+
+	l := newSender()
+	defer l.Stop()
+	if l.httpTransport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("Unexpected default min TLS version %#x", l.httpTransport.TLSClientConfig.MinVersion)
+	}
+	if err := l.Ping(); err == nil {
+		t.Fatal("Expected the handshake with a TLS 1.1 listener to fail")
+	}
+
+	legacy := newSender(SetMinTLSVersion(tls.VersionTLS11))
+	defer legacy.Stop()
+	if err := legacy.Ping(); err != nil {
+		t.Fatalf("Unexpected error with a min TLS version of 1.1: %v", err)
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMinTLSVersion(tls.VersionSSL30)); err == nil {
+		t.Fatal("Expected an error for SSL 3.0")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMinTLSVersion(tls.VersionTLS12), SetSharedTransport(&http.Transport{})); err == nil {
+		t.Fatal("Expected an error for a min TLS version with a shared transport")
+	}
+}
+
+func TestLogzioSender_ConnectTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetConnectTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	// the transport dials with the dialer bounded by the connect timeout
+	if l.dialer.Timeout != 200*time.Millisecond {
+		t.Fatalf("Unexpected dial timeout %v", l.dialer.Timeout)
+	}
+	if err := l.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	// a dial past the deadline of that dialer fails right away
+	l.CloseIdleConnections()
+	l.dialer.Deadline = time.Now().Add(-time.Second)
+	if err := l.Ping(); err == nil {
+		t.Fatal("Expected a dial error past the dialer deadline")
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetConnectTimeout(0)); err == nil {
+		t.Fatal("Expected an error for a zero connect timeout")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetConnectTimeout(time.Second), SetSharedTransport(&http.Transport{})); err == nil {
+		t.Fatal("Expected an error for a connect timeout with a shared transport")
+	}
+}
+
+func TestLogzioSender_SharedTransport(t *testing.T) {
+	var mux sync.Mutex
+	connections := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mux.Lock()
+			connections++
+			mux.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	var senders []*LogzioSender
+	for _, token := range []string{"tenant-a", "tenant-b"} {
+		l, err := New(token, SetUrl(ts.URL), SetInMemoryQueue(true), SetSharedTransport(transport), SetDrainDuration(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Stop()
+		senders = append(senders, l)
+	}
+	for _, l := range senders {
+		l.Send([]byte("blah"))
+		l.Drain()
+		// doesn't close the connection used by the other sender
+		l.CloseIdleConnections()
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if connections != 1 {
+		t.Fatalf("%d connections for 2 senders sharing a transport", connections)
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetProxy("http://proxy:3128"), SetSharedTransport(transport)); err == nil {
+		t.Fatal("expected an error for a proxy with a shared transport")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetSharedTransport(transport), SetProxyBasicAuth("u", "p")); err == nil {
+		t.Fatal("expected an error for a proxy with a shared transport")
+	}
+}
+
+func TestLogzioSender_SkipEmpty(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetRetryPolicy(noRetryPolicy{}), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for _, payload := range [][]byte{nil, {}, []byte(" \t\r\n")} {
+		if err := l.Send(payload); err != ErrEmptyPayload {
+			t.Fatalf("Unexpected error %v for %q", err, payload)
+		}
+		if n, err := l.Write(payload); n != len(payload) || err != nil {
+			t.Fatalf("Unexpected write %d %v for %q", n, err, payload)
+		}
+	}
+	if err := l.Send([]byte(" blah ")); err != nil {
+		t.Fatal(err)
+	}
+	if l.QueueCount() != 1 {
+		t.Fatalf("%d logs queued, expected only the non blank log", l.QueueCount())
+	}
+
+	keep, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetSkipEmpty(false), SetRetryPolicy(noRetryPolicy{}), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keep.Stop()
+	if err := keep.Send(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := keep.Send([]byte(" ")); err != nil {
+		t.Fatal(err)
+	}
+	if keep.QueueCount() != 2 {
+		t.Fatalf("%d logs queued, expected the blank logs", keep.QueueCount())
+	}
+}
+
+func TestToValidUTF8(t *testing.T) {
+	cases := map[string]string{
+		"":                        "",
+		"blah":                    "blah",
+		"h\u00e9llo \u4e16\u754c": "h\u00e9llo \u4e16\u754c",
+		"a\xffb":                  "a\uFFFDb",
+		"a\xff\xfe\xfdb":          "a\uFFFDb",
+		"\xc3":                    "\uFFFD",
+		"\xed\xa0\x80":            "\uFFFD",
+		"a\xffb\x80c":             "a\uFFFDb\uFFFDc",
+	}
+	for in, expected := range cases {
+		if got := string(toValidUTF8([]byte(in))); got != expected {
+			t.Errorf("%q: %q != %q", in, got, expected)
+		}
+	}
+}
+
+func TestLogzioSender_SanitizeUTF8(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		if !utf8.Valid(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetSanitizeUTF8(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("good"))
+	l.Send([]byte("bad \xff\xfe log"))
+	if res := l.DrainWithResult(); res.SentLogs != 2 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if string(body) != "good\nbad \uFFFD log\n" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+}
+
+func TestLogzioSender_MaxItemsPerCall(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetSplitLines(true),
+		SetMaxItemsPerCall(2),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if err := l.SendBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != ErrTooManyItems {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if n, err := l.Write([]byte("a\nb\nc")); n != 0 || err != ErrTooManyItems {
+		t.Fatalf("Unexpected write %d %v", n, err)
+	}
+	if l.QueueCount() != 0 {
+		t.Fatalf("%d logs queued by rejected calls", l.QueueCount())
+	}
+	if err := l.SendBatch([][]byte{[]byte("a"), nil}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := l.Write([]byte("b\nc\n")); n != 4 || err != nil {
+		t.Fatalf("Unexpected write %d %v", n, err)
+	}
+	if l.QueueCount() != 3 {
+		t.Fatalf("%d logs queued, expected 3", l.QueueCount())
+	}
+}
+
+func TestLogzioSender_DrainOnFull(t *testing.T) {
+	var mux sync.Mutex
+	var sent []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		sent = append(sent, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	for _, drainOnFull := range []bool{false, true} {
+		mux.Lock()
+		sent = nil
+		mux.Unlock()
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetInMemoryQueue(true),
+			SetInMemoryCapacity(20),
+			SetDrainOnFull(drainOnFull),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			l.Send([]byte(fmt.Sprintf("log-%d", i)))
+		}
+		l.Stop()
+		mux.Lock()
+		delivered := len(sent)
+		mux.Unlock()
+		dropped := l.Metrics().DroppedLogs
+		if drainOnFull && (delivered != 10 || dropped != 0) {
+			t.Fatalf("%d logs delivered and %d dropped with drain on full", delivered, dropped)
+		}
+		if !drainOnFull && (delivered != 4 || dropped != 6) {
+			t.Fatalf("%d logs delivered and %d dropped without drain on full", delivered, dropped)
+		}
+	}
+}
+
+func TestSetDrainDuration(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), SetDrainDuration(d)); err == nil {
+			t.Fatalf("expected an error for %v", d)
+		}
+	}
+	l, err := New("fake-token", SetInMemoryQueue(true), SetDrainDuration(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if l.drainDuration != time.Millisecond {
+		t.Fatalf("Unexpected drain duration %v", l.drainDuration)
+	}
+}
+
+func TestLogzioSender_DrainTimerZeroDuration(t *testing.T) {
+	c := newFakeClock()
+	// the clock never reaches the first drain
+	l := &LogzioSender{clock: c}
+	go l.drainTimer()
+	select {
+	case d := <-c.sleeps:
+		if d != defaultDrainDuration {
+			t.Fatalf("Unexpected drain timer sleep %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no drain timer sleep")
+	}
+}
+
+func TestLogzioSender_AppendNewline(t *testing.T) {
+	var mux sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		defer mux.Unlock()
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			// the requeued batch keeps its framing
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	cases := []struct {
+		appendNewline bool
+		expected      string
+	}{
+		{true, "a\nb\n\n"},
+		{false, "ab\n"},
+	}
+	for _, c := range cases {
+		mux.Lock()
+		bodies = nil
+		mux.Unlock()
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetInMemoryQueue(true),
+			SetAppendNewline(c.appendNewline),
+			SetRetryPolicy(noRetryPolicy{}),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("a"))
+		l.Send([]byte("b\n"))
+		l.Drain()
+		l.Drain()
+		l.Stop()
+		mux.Lock()
+		if len(bodies) != 2 || bodies[0] != c.expected || bodies[1] != c.expected {
+			t.Fatalf("Unexpected bodies %q with append newline %v", bodies, c.appendNewline)
+		}
+		mux.Unlock()
+	}
+}
+
+func TestLogzioSender_Synchronous(t *testing.T) {
+	var status int32 = http.StatusOK
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetSynchronous(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if err := l.Send([]byte("blah")); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 1 || l.QueueCount() != 0 {
+		t.Fatal("log was not sent by Send")
+	}
+	if err := l.SendNoCopy([]byte("blah")); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 2 || l.QueueCount() != 0 {
+		t.Fatal("log was not sent by SendNoCopy")
+	}
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	err = l.Send([]byte("blah"))
+	if e, ok := err.(*SendError); !ok || e.StatusCode != http.StatusServiceUnavailable || !e.Requeued {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	err = l.Send([]byte("blah"))
+	if e, ok := err.(*SendError); !ok || e.StatusCode != http.StatusBadRequest || e.Requeued {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// concurrent with the background drains of the 1ms drain duration
+	atomic.StoreInt32(&status, http.StatusOK)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Send([]byte("blah")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if l.QueueCount() != 0 {
+		t.Fatalf("%d logs left after synchronous sends", l.QueueCount())
+	}
+}
+
+func TestSetListener(t *testing.T) {
+	for _, tc := range []struct {
+		host     string
+		port     int
+		secure   bool
+		expected string
+	}{
+		{"listener.logz.io", 0, true, "https://listener.logz.io:8071/?token=fake-token"},
+		{"listener-eu.logz.io", 8071, true, "https://listener-eu.logz.io:8071/?token=fake-token"},
+		{"localhost", 8070, false, "http://localhost:8070/?token=fake-token"},
+		{"::1", 0, false, "http://[::1]:8071/?token=fake-token"},
+	} {
+		l, err := New("fake-token", SetInMemoryQueue(true), SetListener(tc.host, tc.port, tc.secure))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.url.Load(); got != tc.expected {
+			t.Errorf("%s %d %t: %s != %s", tc.host, tc.port, tc.secure, got, tc.expected)
+		}
+		l.Stop()
+	}
+	for _, option := range []SenderOptionFunc{SetListener("", 0, true), SetListener("localhost", -1, true), SetListener("localhost", 65536, true)} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), option); err == nil {
+			t.Fatal("Expected an error for an invalid listener")
+		}
+	}
+}
+
+func TestSetQueryParam(t *testing.T) {
+	var query atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query.Store(r.URL.Query())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetQueryParam("account", "sub-1"),
+		SetUrl(ts.URL),
+		SetQueryParam("env", "a b&c"),
+		SetQueryParam("env", "prod"),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	l.Drain()
+	q, _ := query.Load().(url.Values)
+	if q.Get("token") != "fake-token" || q.Get("account") != "sub-1" {
+		t.Fatalf("Unexpected query %v", q)
+	}
+	if env := q["env"]; len(env) != 2 || env[0] != "a b&c" || env[1] != "prod" {
+		t.Fatalf("Unexpected env params %v", env)
+	}
+	for _, key := range []string{"", "token"} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), SetQueryParam(key, "x")); err == nil {
+			t.Fatalf("Expected an error for the query param %q", key)
+		}
+	}
+}
+
+func TestSetTrimTrailingNewline(t *testing.T) {
+	var body atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reader = gz
+		}
+		b, _ := ioutil.ReadAll(reader)
+		body.Store(string(b))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	for _, tc := range []struct {
+		trim     bool
+		compress bool
+		expected string
+	}{
+		{false, false, "first\nsecond\n"},
+		{true, false, "first\nsecond"},
+		{true, true, "first\nsecond"},
+	} {
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetTrimTrailingNewline(tc.trim),
+			SetCompress(tc.compress),
+			SetInMemoryQueue(true),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("first"))
+		l.Send([]byte("second"))
+		if err := l.DrainSync(); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := body.Load().(string); got != tc.expected {
+			t.Errorf("trim %t compress %t: unexpected body %q", tc.trim, tc.compress, got)
+		}
+		l.Stop()
+	}
+}
+
+func TestLogzioSender_ExportQueue(t *testing.T) {
+	for _, destructive := range []bool{false, true} {
+		l, err := New(
+			"fake-token",
+			SetUrl("http://localhost:12345"),
+			SetTempDirectory(fmt.Sprintf("%s/logzio-export-%d", os.TempDir(), time.Now().UnixNano())),
+			SetCheckDiskSpace(false),
+			SetDrainDuration(time.Hour),
+			SetDestructiveExport(destructive),
+			SetRetryPolicy(noRetryPolicy{}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte(`{"msg":"one"}`))
+		l.Send([]byte(`{"msg":"two"}`))
+		l.queue.Enqueue([]byte("three\nfour"))
+		var out bytes.Buffer
+		n, err := l.ExportQueue(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "{\"msg\":\"one\"}\n{\"msg\":\"two\"}\nthree\nfour\n"
+		if n != 4 || out.String() != expected {
+			t.Fatalf("destructive %t: exported %d logs %q", destructive, n, out.String())
+		}
+		queued := uint64(3)
+		if destructive {
+			queued = 0
+		}
+		if l.QueueCount() != queued {
+			t.Fatalf("destructive %t: %d items queued after the export", destructive, l.QueueCount())
+		}
+		l.Stop()
+		os.RemoveAll(l.dir)
+	}
+}
+
+func TestLogzioSender_ExportQueueWriteError(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetDestructiveExport(true), SetRetryPolicy(noRetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	if _, err := l.ExportQueue(failingWriter{}); err == nil {
+		t.Fatal("Expected the write error")
+	}
+	if l.QueueCount() != 1 {
+		t.Fatalf("%d items queued after a failed export", l.QueueCount())
+	}
+}
+
+func TestLogzioSender_ImportQueue(t *testing.T) {
+	newSender := func(options ...SenderOptionFunc) *LogzioSender {
+		options = append([]SenderOptionFunc{
+			SetUrl("http://localhost:12345"),
+			SetInMemoryQueue(true),
+			SetDrainDuration(time.Hour),
+			SetRetryPolicy(noRetryPolicy{}),
+		}, options...)
+		l, err := New("fake-token", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	exporter := newSender()
+	defer exporter.Stop()
+	exporter.Send([]byte("one"))
+	exporter.Send([]byte("two"))
+	exporter.queue.Enqueue([]byte("three\nfour"))
+	var dump bytes.Buffer
+	exported, err := exporter.ExportQueue(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importer := newSender()
+	defer importer.Stop()
+	imported, err := importer.ImportQueue(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != exported || importer.QueueCount() != uint64(exported) {
+		t.Fatalf("exported %d, imported %d, queued %d", exported, imported, importer.QueueCount())
+	}
+	var out bytes.Buffer
+	importer.ExportQueue(&out)
+	if out.String() != "one\ntwo\nthree\nfour\n" {
+		t.Fatalf("Unexpected queue after the import %q", out.String())
+	}
+
+	// a last line without a newline and empty lines
+	partial := newSender()
+	defer partial.Stop()
+	if n, err := partial.ImportQueue(strings.NewReader("a\n\nb")); n != 2 || err != nil {
+		t.Fatalf("imported %d logs: %v", n, err)
+	}
+
+	// stops when the queue is full
+	small := newSender(SetInMemoryCapacity(10))
+	defer small.Stop()
+	n, err := small.ImportQueue(strings.NewReader("1234\n5678\nabcd\n"))
+	if n != 2 || err != ErrQueueFull {
+		t.Fatalf("imported %d logs in a full queue: %v", n, err)
+	}
+}
+
+func TestLogzioSender_CheckpointRestore(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetDestructiveExport(true), SetRetryPolicy(noRetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("one"))
+	l.Send([]byte("two"))
+	l.Send([]byte("three"))
+	var checkpoint bytes.Buffer
+	if err := l.Checkpoint(&checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	// the logs stay queued even with a destructive export
+	if l.QueueCount() != 3 {
+		t.Fatalf("%d items queued after the checkpoint", l.QueueCount())
+	}
+	l.Stop()
+
+	restored, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetRetryPolicy(noRetryPolicy{}), SetRestoreFrom(&checkpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Stop()
+	var out bytes.Buffer
+	restored.ExportQueue(&out)
+	if out.String() != "one\ntwo\nthree\n" {
+		t.Fatalf("Unexpected queue after the restore %q", out.String())
+	}
+
+	// a queue too small for the checkpoint fails New
+	_, err = New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetInMemoryCapacity(4), SetRestoreFrom(strings.NewReader("1234\n5678\n")))
+	if err == nil {
+		t.Fatal("Expected an error restoring into a full queue")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestLogzioSender_MaxLifetime(t *testing.T) {
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetMaxLifetime(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Send([]byte("blah")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-bodies:
+		if body != "blah\n" {
+			t.Fatalf("Unexpected body %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No final drain after the max lifetime")
+	}
+	for start := time.Now(); !l.stopped.Load(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Sender not stopped after the max lifetime")
+		}
+	}
+	if err := l.Send([]byte("blah")); err != ErrSenderClosed {
+		t.Fatalf("Unexpected error after the max lifetime %v", err)
+	}
+	if _, err := l.Write([]byte("blah")); err != ErrSenderClosed {
+		t.Fatalf("Unexpected write error after the max lifetime %v", err)
+	}
+	// already stopped
+	l.Stop()
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMaxLifetime(0)); err == nil {
+		t.Fatal("Expected an error for a zero max lifetime")
+	}
+}
+
+func TestLogzioSender_StopAsync(t *testing.T) {
+	var received int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt64(&received, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	start := time.Now()
+	done := l.StopAsync()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("StopAsync blocked for %v", elapsed)
+	}
+	if err := l.Send([]byte("blah")); err != ErrSenderClosed {
+		t.Fatalf("Expected ErrSenderClosed after StopAsync, got %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The final drain didn't complete")
+	}
+	if n := atomic.LoadInt64(&received); n != 1 {
+		t.Fatalf("Expected the final drain to send the log, got %d requests", n)
+	}
+	if _, err := l.queue.Peek(); err != goque.ErrDBClosed {
+		t.Fatalf("Expected the queue to be closed, got %v", err)
+	}
+	if err := <-l.StopAsync(); err != ErrSenderClosed {
+		t.Fatalf("Expected ErrSenderClosed stopping again, got %v", err)
+	}
+}
+
+func TestLogzioSender_DrainUpTo(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetMaxBatchCount(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 0; i < 10; i++ {
+		l.Send([]byte("1234"))
+	}
+	// 5 bytes per log with its newline, the 4th log would exceed the budget
+	sent, err := l.DrainUpTo(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 15 || l.QueueCount() != 7 {
+		t.Fatalf("sent %d bytes, %d logs queued", sent, l.QueueCount())
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("%d requests", n)
+	}
+	// a log larger than the budget stays queued
+	if sent, err := l.DrainUpTo(4); sent != 0 || err != nil || l.QueueCount() != 7 {
+		t.Fatalf("sent %d bytes over a too small budget, %d logs queued: %v", sent, l.QueueCount(), err)
+	}
+	if _, err := l.DrainUpTo(0); err == nil {
+		t.Fatal("Expected an error for a zero budget")
+	}
+}
+
+func TestLogzioSender_DrainUnderContinuousSend(t *testing.T) {
+	var l *LogzioSender
+	// every request sends a new log, the queue never runs empty
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Send([]byte("during"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetMaxBatchCount(1),
+		SetDestructiveExport(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 0; i < 10; i++ {
+		l.Send([]byte("before"))
+	}
+	// the drain sends the logs queued when it started and leaves the ones sent during it
+	result := l.DrainWithResult()
+	if result.SentLogs != 10 {
+		t.Fatalf("Expected the 10 logs queued before the drain to be sent, sent %d", result.SentLogs)
+	}
+	if count := l.QueueCount(); count != 10 {
+		t.Fatalf("Expected the 10 logs sent during the drain to be queued, got %d", count)
+	}
+	// don't send the logs enqueued during the drain on Stop
+	l.ExportQueue(ioutil.Discard)
+}
+
+func TestLogzioSender_MaxDrainDuration(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetMaxBatchCount(1),
+		SetMaxDrainDuration(300*time.Millisecond),
+		SetDestructiveExport(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for i := 0; i < 3; i++ {
+		l.Send([]byte("blah"))
+	}
+	start := time.Now()
+	result := l.DrainWithResult()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the drain took %v", elapsed)
+	}
+	if result.SentLogs != 0 || l.QueueCount() != 3 {
+		t.Fatalf("sent %d logs, %d logs queued", result.SentLogs, l.QueueCount())
+	}
+	// don't send the logs on Stop
+	l.ExportQueue(ioutil.Discard)
+
+	if _, err := New("fake-token", SetMaxDrainDuration(-time.Second)); err == nil {
+		t.Fatal("Expected an error for a negative max drain duration")
+	}
+}
+
+func TestLogzioSender_DrainUpToFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetRetryPolicy(noRetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	sent, err := l.DrainUpTo(1024)
+	if e, ok := err.(*SendError); !ok || e.StatusCode != http.StatusServiceUnavailable || !e.Requeued || sent != 0 {
+		t.Fatalf("Unexpected drain %d %v", sent, err)
+	}
+}
+
+func TestLogzioSender_QueueName(t *testing.T) {
+	name := fmt.Sprintf("queue-name-test-%d", time.Now().UnixNano())
+	expected := filepath.Join(os.TempDir(), "logzio-buffer", name)
+	defer os.RemoveAll(expected)
+	newSender := func() *LogzioSender {
+		l, err := New(
+			"fake-token",
+			SetUrl("http://localhost:12345"),
+			SetQueueName(name),
+			SetCheckDiskSpace(false),
+			SetDrainDuration(time.Hour),
+			SetRetryPolicy(noRetryPolicy{}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	l := newSender()
+	if l.dir != expected {
+		t.Fatalf("Unexpected queue directory %s", l.dir)
+	}
+	l.Send([]byte("blah"))
+	// the final drain fails and requeues the log
+	l.Stop()
+
+	restarted := newSender()
+	defer restarted.Stop()
+	if restarted.dir != expected || restarted.QueueCount() != 1 {
+		t.Fatalf("the restarted sender has %d logs queued in %s", restarted.QueueCount(), restarted.dir)
+	}
+
+	for _, invalid := range []string{"", "..", "a/b"} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), SetQueueName(invalid)); err == nil {
+			t.Fatalf("Expected an error for queue name %q", invalid)
+		}
+	}
+}
+
+func TestLogzioSender_MaxConcurrentSends(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		l, err := New(
+			"fake-token",
+			SetUrl("http://localhost:12345"),
+			SetInMemoryQueue(true),
+			SetDrainDuration(time.Hour),
+			SetRetryPolicy(noRetryPolicy{}),
+			SetMaxConcurrentSends(1),
+			SetFailFastSends(failFast),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// another caller holds the only slot
+		l.acquireSend()
+		done := make(chan error, 1)
+		go func() {
+			done <- l.Send([]byte("blah"))
+		}()
+		if failFast {
+			if err := <-done; err != ErrSendBusy {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if _, err := l.Write([]byte("blah")); err != ErrSendBusy {
+				t.Fatalf("Unexpected write error %v", err)
+			}
+			l.releaseSend()
+		} else {
+			select {
+			case err := <-done:
+				t.Fatalf("Send did not wait for the slot: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			l.releaseSend()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Send([]byte("blah")); err != nil {
+			t.Fatalf("failFast %t: the slot was not released: %v", failFast, err)
+		}
+		l.Stop()
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMaxConcurrentSends(-1)); err == nil {
+		t.Fatal("Expected an error for negative max concurrent sends")
+	}
+}
+
+func TestLogzioSender_SendJSON(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetRetryPolicy(noRetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	type event struct {
+		Message string `json:"message"`
+		Count   int    `json:"count"`
+	}
+	if err := l.SendJSON(event{Message: "hello", Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SendJSON(map[string]interface{}{"message": "world", "ok": true}); err != nil {
+		t.Fatal(err)
+	}
+	err = l.SendJSON(map[string]interface{}{"unsupported": make(chan int)})
+	if e, ok := err.(*MarshalError); !ok || e.Err == nil {
+		t.Fatalf("Unexpected marshal error %v", err)
+	}
+	var out bytes.Buffer
+	l.ExportQueue(&out)
+	if out.String() != "{\"message\":\"hello\",\"count\":2}\n{\"message\":\"world\",\"ok\":true}\n" {
+		t.Fatalf("Unexpected queue %q", out.String())
+	}
+}
+
+func TestLogzioSender_SetMarshaler(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetMarshaler(func(v interface{}) ([]byte, error) {
+			return []byte(fmt.Sprintf("custom %v", v)), nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.SendJSON(42)
+	if peek := l.PeekQueue(1); len(peek) != 1 || string(peek[0]) != "custom 42" {
+		t.Fatalf("Unexpected queue %q", peek)
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMarshaler(nil)); err == nil {
+		t.Fatal("Expected an error for a nil marshaler")
+	}
+}
+
+func setCheckDiskDuration(duration time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.checkDiskDuration = duration
+		return nil
+	}
+}
+
+func TestLogzioSender_DiskCheckLowWaterMark(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl("http://localhost:12345"),
+		SetDrainDiskThreshold(0),
+		SetDiskCheckLowWaterMark(2),
+		SetDrainDuration(time.Minute),
+		setCheckDiskDuration(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.queue.Close()
+	l.Send([]byte("blah"))
+	<-time.After(100 * time.Millisecond)
+	// below the low water mark the disk is not checked
+	if err := l.enqueue([]byte("blah")); err != nil {
+		t.Fatalf("Unexpected drop below the low water mark %v", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	if err := l.enqueue([]byte("blah")); err != ErrQueueFull {
+		t.Fatalf("Expected a drop above the low water mark, got %v", err)
+	}
+}
+
+func setDiskUsage(usage func(path string) (*disk.UsageStat, error)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskUsage = usage
+		return nil
+	}
+}
+
+func failingDiskUsage(path string) (*disk.UsageStat, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestLogzioSender_DiskUsageFallback(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl("http://localhost:12345"),
+		SetDiskUsageFallback(2),
+		SetDrainDuration(time.Minute),
+		setCheckDiskDuration(10*time.Millisecond),
+		setDiskUsage(failingDiskUsage),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.queue.Close()
+	<-time.After(100 * time.Millisecond)
+	if !l.diskUsageFailed.Load() {
+		t.Fatal("Expected the disk usage error to be detected")
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.enqueue([]byte("blah")); err != nil {
+			t.Fatalf("Unexpected drop below the fallback cap %v", err)
+		}
+	}
+	if err := l.enqueue([]byte("blah")); err != ErrQueueFull {
+		t.Fatalf("Expected a drop at the fallback cap, got %v", err)
+	}
+}
+
+func TestLogzioSender_DiskUsageErrorDisablesCheck(t *testing.T) {
+	l, err := New(
+		"fake-token",
+		SetDebug(os.Stderr),
+		SetUrl("http://localhost:12345"),
+		SetDrainDuration(time.Minute),
+		setCheckDiskDuration(10*time.Millisecond),
+		setDiskUsage(failingDiskUsage),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.queue.Close()
+	<-time.After(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := l.enqueue([]byte("blah")); err != nil {
+			t.Fatalf("Unexpected drop without the disk usage check %v", err)
+		}
+	}
+}
+
+func BenchmarkLogzioSender(b *testing.B) {
+	b.ReportAllocs()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	l, _ := New("fake-token", SetUrl(ts.URL), SetDrainDuration(time.Hour))
+	defer ts.Close()
+	defer l.Stop()
+	msg := []byte("test")
+	for i := 0; i < b.N; i++ {
+		l.Send(msg)
+	}
+}
+
+func TestLogzioSender_BufferPool(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	borrowed := 0
+	pool := &sync.Pool{New: func() interface{} {
+		borrowed++
+		return new(bytes.Buffer)
+	}}
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetBufferPool(pool), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if l.buf != nil {
+		t.Fatal("buffer allocated before the first drain")
+	}
+	l.Send([]byte("blah"))
+	if res := l.DrainWithResult(); res.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if l.buf != nil || borrowed != 1 {
+		t.Fatalf("buffer not returned to the pool, borrowed %d", borrowed)
+	}
+	buf, ok := pool.Get().(*bytes.Buffer)
+	if !ok || buf.Len() != 0 {
+		t.Fatal("buffer returned to the pool without being reset")
+	}
+}
+
+func BenchmarkLogzioSender_ManySenders(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	pool := &sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%v", pooled), func(b *testing.B) {
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			senders := make([]*LogzioSender, 50)
+			for i := range senders {
+				options := []SenderOptionFunc{SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour)}
+				if pooled {
+					options = append(options, SetBufferPool(pool))
+				}
+				senders[i], _ = New("fake-token", options...)
+				defer senders[i].Stop()
+			}
+			msg := []byte("test")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, l := range senders {
+					l.Send(msg)
+					l.Drain()
+				}
+			}
+			b.StopTimer()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.Logf("heap used by %d senders: %d KB", len(senders), (int64(after.HeapInuse)-int64(before.HeapInuse))/1024)
+		})
+	}
+}
+
+func TestLogzioSender_SendNoCopy(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	payload := make([]byte, 4, 16)
+	copy(payload, "blah")
+	if err := l.SendNoCopy(payload); err != nil {
+		t.Fatal(err)
+	}
+	item, _ := l.queue.Peek()
+	if &item.Value[0] != &payload[0] {
+		t.Fatal("payload was copied")
+	}
+	if err := l.SendNoCopy(payload[4:]); err != ErrEmptyPayload {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	l.Send([]byte("second"))
+	l.Drain()
+	if string(body) != "blah\nsecond\n" || string(payload) != "blah" {
+		t.Fatalf("Unexpected body %q and payload %q", body, payload)
+	}
+}
+
+func BenchmarkLogzioSender_SendNoCopy(b *testing.B) {
+	for _, noCopy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("noCopy=%v", noCopy), func(b *testing.B) {
+			l, _ := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+			defer l.queue.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a new payload each time, SendNoCopy callers don't reuse it
+				payload := make([]byte, 1024)
+				if noCopy {
+					l.SendNoCopy(payload)
+				} else {
+					l.Send(payload)
+				}
+				// keep the queue nearly empty
+				l.queue.Dequeue()
+			}
+		})
+	}
+}
+
+// run with -race as well, many goroutines send to the disk queue at once
+func BenchmarkLogzioSender_MaxConcurrentSends(b *testing.B) {
+	for _, n := range []int{0, 4} {
+		b.Run(fmt.Sprintf("max=%d", n), func(b *testing.B) {
+			l, err := New(
+				"fake-token",
+				SetUrl("http://localhost:12345"),
+				SetTempDirectory(fmt.Sprintf("%s/logzio-concurrent-%d", os.TempDir(), time.Now().UnixNano())),
+				SetCheckDiskSpace(false),
+				SetDrainDuration(time.Hour),
+				SetMaxConcurrentSends(n),
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(l.dir)
+			defer l.queue.Close()
+			payload := []byte(`{"message":"fan-in"}`)
+			b.SetParallelism(100)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					l.Send(payload)
+				}
+			})
+		})
+	}
+}
+
+type benchEvent struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+// appendBenchEvent stands in for a faster JSON library
+func appendBenchEvent(v interface{}) ([]byte, error) {
+	e, ok := v.(benchEvent)
+	if !ok {
+		return json.Marshal(v)
+	}
+	b := append([]byte(`{"message":`), strconv.Quote(e.Message)...)
+	b = append(b, `,"count":`...)
+	b = strconv.AppendInt(b, int64(e.Count), 10)
+	return append(b, '}'), nil
+}
+
+func BenchmarkLogzioSender_SendJSON(b *testing.B) {
+	marshalers := map[string]func(interface{}) ([]byte, error){"encoding/json": json.Marshal, "custom": appendBenchEvent}
+	for name, marshal := range marshalers {
+		b.Run(name, func(b *testing.B) {
+			l, _ := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour), SetMarshaler(marshal))
+			defer l.queue.Close()
+			event := benchEvent{Message: "hello", Count: 42}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.SendJSON(event)
+				// keep the queue nearly empty
+				l.queue.Dequeue()
+			}
+		})
+	}
+}
+
+func BenchmarkLogzioSender_SendLowOccupancy(b *testing.B) {
+	for _, mark := range []uint64{0, 1000} {
+		b.Run(fmt.Sprintf("lowWaterMark=%d", mark), func(b *testing.B) {
+			b.ReportAllocs()
+			// count and time the disk usage checks a nearly empty queue asks for
+			var calls, spent int64
+			l, _ := New(
+				"fake-token",
+				SetUrl("http://localhost:12345"),
+				SetDiskCheckLowWaterMark(mark),
+				SetDrainDuration(time.Hour),
+				setCheckDiskDuration(time.Millisecond),
+				setDiskUsage(func(path string) (*disk.UsageStat, error) {
+					start := time.Now()
+					defer func() {
+						atomic.AddInt64(&calls, 1)
+						atomic.AddInt64(&spent, int64(time.Since(start)))
+					}()
+					return disk.Usage(path)
+				}),
+			)
+			defer os.RemoveAll(l.dir)
+			defer l.queue.Close()
+			msg := []byte("test")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.Send(msg)
+				// keep the queue nearly empty
+				l.queue.Dequeue()
+			}
+			b.StopTimer()
+			b.Logf("%d disk usage checks took %v", atomic.LoadInt64(&calls), time.Duration(atomic.LoadInt64(&spent)))
+		})
 	}
 }
@@ -15,15 +15,30 @@
 package logzio
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/beeker1121/goque"
 	"github.com/shirou/gopsutil/disk"
@@ -32,14 +47,61 @@ import (
 
 const (
 	maxSize               = 3 * 1024 * 1024 // 3 mb
+	defaultBufferCapacity = maxSize
 	sendSleepingBackoff   = time.Second * 2
 	sendRetries           = 4
 	defaultHost           = "https://listener.logz.io:8071"
+	defaultListenerPort   = 8071
 	defaultDrainDuration  = 5 * time.Second
 	defaultDiskThreshold  = 95.0 // represent % of the disk
 	defaultCheckDiskSpace = true
+	defaultMemoryCapacity = 20 * 1024 * 1024 // 20 mb
+	defaultContentType    = "text/plain"
+	drainOnFullTimeout    = time.Second
+	defaultLogCountLimit  = 500000
+	defaultMinTLSVersion  = tls.VersionTLS12
 
-	httpError = -1
+	httpError = -1 // transient transport error such as a timeout or a refused connection
+	dnsError  = -2 // the listener host could not be resolved
+	tlsError  = -3 // the TLS handshake or the certificate verification failed
+)
+
+// ErrQueueFull is returned by Write when the log is dropped because the queue is full
+var ErrQueueFull = errors.New("logzio: queue is full, log dropped")
+
+// ErrEmptyPayload is returned by Send when an empty or whitespace only payload is skipped
+var ErrEmptyPayload = errors.New("logzio: empty payload, log skipped")
+
+// ErrTooManyItems is returned by SendBatch and Write when a call holds more logs than SetMaxItemsPerCall allows
+var ErrTooManyItems = errors.New("logzio: too many logs in one call, nothing enqueued")
+
+// ErrSenderClosed is returned by Send and Write once the sender was stopped
+var ErrSenderClosed = errors.New("logzio: sender is stopped, log dropped")
+
+// ErrSendBusy is returned by Send and Write when SetMaxConcurrentSends callers are already enqueuing
+// and SetFailFastSends is used
+var ErrSendBusy = errors.New("logzio: too many concurrent sends, log dropped")
+
+// ErrUnauthorized is returned by Ping when the listener rejects the token
+var ErrUnauthorized = errors.New("logzio: listener rejected the token")
+
+// UnreachableError is returned by Ping when the listener can't be reached
+type UnreachableError struct {
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("logzio: listener is unreachable: %v", e.Err)
+}
+
+// FullPolicy decides which logs are dropped when the queue is full
+type FullPolicy int
+
+const (
+	// DropNewest drops the incoming log, the default
+	DropNewest FullPolicy = iota
+	// DropOldest evicts the oldest queued logs to make room for the incoming log
+	DropOldest
 )
 
 // Sender Alias to LogzioSender
@@ -47,21 +109,129 @@ type Sender LogzioSender
 
 // LogzioSender instance of the
 type LogzioSender struct {
-	queue             *goque.Queue
+	queue             genericQueue
 	drainDuration     time.Duration
+	maxDrainTime      time.Duration
 	buf               *bytes.Buffer
 	draining          atomic.Bool
 	mux               sync.Mutex
+	configMux         sync.RWMutex // held by Reconfigure while it applies the options
 	token             string
-	url               string
+	url               atomic.String
 	debug             io.Writer
 	diskThreshold     float32
 	checkDiskSpace    bool
-	fullDisk          bool
+	fullDisk          atomic.Bool
 	checkDiskDuration time.Duration
 	dir               string
 	httpClient        *http.Client
 	httpTransport     *http.Transport
+	inMemoryQueue     bool
+	queueSwap         sync.RWMutex // held for writing by MigrateQueue, for reading by the enqueue
+	diskCheckOnce     sync.Once
+	syncOnStop        bool
+	inMemoryCapacity  uint64
+	logCountLimit     int
+	fallbackToMemory  bool
+	proxyURL          *url.URL
+	proxyAuth         *url.Userinfo
+	bufferCapacity    int
+	queueFull         atomic.Bool
+	queueStateFunc    func(full bool)
+	compress          bool
+	startupJitter     time.Duration
+	startupDelay      time.Duration
+	verifyOnStart     bool
+	splitLines        bool
+	fullPolicy        FullPolicy
+	stats             senderStats
+	bufEnds           []int
+	maxRequestBytes   int
+	diskLowWaterMark  uint64
+	retryPolicy       RetryPolicy
+	sink              Sink
+	contentType       string
+	httpMethod        string
+	requestDecorator  func(req *http.Request)
+	interceptor       func(req *http.Request) error
+	respInterceptor   func(resp *http.Response) error
+	incompatible      IncompatibleQueuePolicy
+	heartbeatEvery    time.Duration
+	heartbeat         []byte
+	staleField        string
+	staleMaxAge       time.Duration
+	bufferPool        *sync.Pool
+	structuredDebug   bool
+	debugLevel        DebugLevel
+	droppedLogs       atomic.Uint64
+	unreportedDrops   atomic.Uint64 // logs dropped since the last delivered batch
+	lastStatusCode    atomic.Int64
+	failedDrains      atomic.Int64
+	circuitOpen       atomic.Bool
+	retryWait         atomic.Int64
+	maxBatchCount     int
+	paused            atomic.Bool
+	maxInFlightBytes  uint64
+	inFlight          *byteBudget
+	clock             clock
+	streamCompression bool
+	forceLength       bool
+	archive           io.Writer
+	warmup            bool
+	unixSocket        string
+	progressFunc      func(sentBytes, remainingBytes uint64)
+	maxLineBytes      int
+	truncMarker       string
+	truncField        string
+	trimNewline       bool
+	linePrefix        []byte
+	lineSuffix        []byte
+	alignedDrain      time.Duration
+	sharedTransport   bool
+	minTLSVersion     uint16
+	connectTimeout    time.Duration
+	dialer            net.Dialer
+	keepEmpty         bool
+	sanitizeUTF8      bool
+	maxItemsPerCall   int
+	drainOnFull       bool
+	synchronous       bool
+	noNewline         bool
+	restoreFrom       io.Reader
+	maxRequeues       int
+	poisonFunc        func(err *PoisonBatchError)
+	poisonBatches     atomic.Uint64
+	destructiveExport bool
+	diskCompress      bool
+	maxLifetime       time.Duration
+	name              string
+	writeBuffer       *writeBuffer
+	noRetryOn404      bool
+	enqueueTimes      enqueueTimes
+	coalesced         coalescedItems
+	sendSlots         chan struct{}
+	trigger           chan struct{}
+	triggerOnce       sync.Once
+	marshal           func(v interface{}) ([]byte, error)
+	isSuccess         func(statusCode int) bool
+	dropLogInterval   time.Duration
+	dropLogLimit      dropLogLimit
+	queryParams       url.Values
+	diskUsage         func(path string) (*disk.UsageStat, error)
+	diskFallbackLogs  uint64
+	diskUsageFailed   atomic.Bool
+	failFastSends     bool
+	stopped           atomic.Bool
+	stopping          chan struct{} // closed by Stop and StopAsync
+	dedup             *dedupWindow
+	dedupedLogs       atomic.Uint64
+	// negotiateCompression, compressionNegotiated, breaker, drainCtx and drainDeadline are only used under mux by the drain
+	negotiateCompression  bool
+	compressionNegotiated bool
+	breaker               *circuitBreaker
+	bufRequeues           []int // requeue count of each item in the buffer, next to bufEnds
+	drainCtx              context.Context
+	drainDeadline         time.Time
 }
 
 // SenderOptionFunc options for logz
@@ -69,21 +239,86 @@ type SenderOptionFunc func(*LogzioSender) error
 
 // New creates a new Logzio sender with a token and options
 func New(token string, options ...SenderOptionFunc) (*LogzioSender, error) {
+	l := newSender(token)
+	for _, option := range options {
+		if err := option(l); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.verifyOnStart {
+		if err := l.Ping(); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.bufferPool == nil {
+		l.buf = l.newBuffer()
+	}
+	if l.inMemoryQueue {
+		l.queue = NewConcurrentQueue()
+	} else {
+		q, err := l.openDiskQueue(l.dir)
+		if err != nil {
+			if _, ok := err.(*IncompatibleQueueError); ok && !l.fallbackToMemory {
+				return nil, err
+			}
+			if !l.fallbackToMemory {
+				return nil, fmt.Errorf("failed to open disk queue at %s: %v", l.dir, err)
+			}
+			l.errorLog("logziosender.go: failed to open disk queue at %s, falling back to in-memory queue: %v\n", l.dir, err)
+			l.inMemoryQueue = true
+			l.queue = NewConcurrentQueue()
+		} else {
+			l.queue = q
+		}
+	}
+	if l.restoreFrom != nil {
+		if _, err := l.ImportQueue(l.restoreFrom); err != nil {
+			l.queue.Close()
+			return nil, fmt.Errorf("failed to restore queue: %v", err)
+		}
+	}
+
+	if l.startupJitter > 0 {
+		l.startupDelay = time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(l.startupJitter)))
+	}
+	go l.start()
+	if !l.inMemoryQueue {
+		l.startDiskCheck()
+	}
+	return l, nil
+}
+
+// newSender returns a sender with the default options, before they are applied
+func newSender(token string) *LogzioSender {
 	l := &LogzioSender{
-		buf:               bytes.NewBuffer(make([]byte, maxSize)),
 		drainDuration:     defaultDrainDuration,
-		url:               fmt.Sprintf("%s/?token=%s", defaultHost, token),
 		token:             token,
 		dir:               fmt.Sprintf("%s%s%s%s%d", os.TempDir(), string(os.PathSeparator), "logzio-buffer", string(os.PathSeparator), time.Now().UnixNano()),
 		diskThreshold:     defaultDiskThreshold,
 		checkDiskSpace:    defaultCheckDiskSpace,
-		fullDisk:          false,
 		checkDiskDuration: 5 * time.Second,
+		inMemoryCapacity:  defaultMemoryCapacity,
+		logCountLimit:     defaultLogCountLimit,
+		bufferCapacity:    defaultBufferCapacity,
+		retryPolicy:       DefaultRetryPolicy{},
+		contentType:       defaultContentType,
+		httpMethod:        http.MethodPost,
+		debugLevel:        DebugLevelDebug,
+		clock:             realClock{},
+		marshal:           json.Marshal,
+		isSuccess:         isSuccess2xx,
+		diskUsage:         disk.Usage,
+		truncMarker:       defaultTruncationMarker,
+		stopping:          make(chan struct{}),
 	}
 
-	tlsConfig := &tls.Config{}
+	l.url.Store(l.listenerURL(defaultHost))
+
+	tlsConfig := &tls.Config{MinVersion: defaultMinTLSVersion}
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy:           http.ProxyFromEnvironment,
 		TLSClientConfig: tlsConfig,
 	}
 	// in case server side is sleeping - wait 10s instead of waiting for him to wake up
@@ -93,28 +328,88 @@ func New(token string, options ...SenderOptionFunc) (*LogzioSender, error) {
 	}
 	l.httpClient = client
 	l.httpTransport = transport
+	return l
+}
 
-	for _, option := range options {
-		if err := option(l); err != nil {
-			return nil, err
+// SetTempDirectory Use this temporary dir for the disk queue, see SetQueueName for a stable directory
+func SetTempDirectory(dir string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.dir = dir
+		return nil
+	}
+}
+
+// SetQueueName to keep the disk queue in <tmp>/logzio-buffer/<name> so a restarted sender reopens
+// its queue, instead of a new directory per sender. SetQueueName and SetTempDirectory both set the
+// queue directory, the last one applied wins
+func SetQueueName(name string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid queue name %q", name)
 		}
+		l.dir = filepath.Join(os.TempDir(), "logzio-buffer", name)
+		return nil
 	}
+}
 
-	q, err := goque.OpenQueue(l.dir)
-	if err != nil {
-		return nil, err
+// SetInMemoryQueue use an in-memory queue instead of the disk queue
+func SetInMemoryQueue(inMemory bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.inMemoryQueue = inMemory
+		return nil
 	}
+}
 
-	l.queue = q
-	go l.start()
-	go l.isEnoughDiskSpace()
-	return l, nil
+// SetInMemoryCapacity to change the maximum bytes held by the in-memory queue
+func SetInMemoryCapacity(size uint64) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.inMemoryCapacity = size
+		return nil
+	}
 }
 
-// SetTempDirectory Use this temporary dir
-func SetTempDirectory(dir string) SenderOptionFunc {
+// SetLogCountLimit to change the maximum number of logs held by the in-memory queue
+func SetLogCountLimit(limit int) SenderOptionFunc {
 	return func(l *LogzioSender) error {
-		l.dir = dir
+		l.logCountLimit = limit
+		return nil
+	}
+}
+
+// SetFallbackToMemoryOnDiskError use the in-memory queue when the disk queue can't be opened
+func SetFallbackToMemoryOnDiskError(fallback bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.fallbackToMemory = fallback
+		return nil
+	}
+}
+
+// SetMaxBufferCapacity to change the capacity the batch buffer keeps between drains,
+// a buffer that grew beyond it is released after the drain
+func SetMaxBufferCapacity(size int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if size < 0 {
+			return fmt.Errorf("invalid buffer capacity %d", size)
+		}
+		l.bufferCapacity = size
+		return nil
+	}
+}
+
+// SetBufferPool to borrow the batch buffer from pool for each drain instead of keeping one per sender,
+// the pool may be shared between senders. pool.New should return a *bytes.Buffer
+func SetBufferPool(pool *sync.Pool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.bufferPool = pool
+		return nil
+	}
+}
+
+// SetQueueStateCallback called once when the queue starts dropping logs (full is true)
+// and once when a log is enqueued again after that (full is false)
+func SetQueueStateCallback(callback func(full bool)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.queueStateFunc = callback
 		return nil
 	}
 }
@@ -122,12 +417,111 @@ func SetTempDirectory(dir string) SenderOptionFunc {
 // SetUrl set the url which maybe different from the defaultUrl
 func SetUrl(url string) SenderOptionFunc {
 	return func(l *LogzioSender) error {
-		l.url = fmt.Sprintf("%s/?token=%s", url, l.token)
-		l.debugLog("logziosender.go: Setting url to %s\n", l.url)
+		l.url.Store(l.listenerURL(url))
+		l.infoLog("logziosender.go: Setting url to %s\n", redactedURL(l.url.Load()))
+		return nil
+	}
+}
+
+// SetListener set the url from its parts, port 0 uses the default listener port 8071
+// and secure chooses https over http
+func SetListener(host string, port int, secure bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if host == "" {
+			return fmt.Errorf("invalid listener host %q", host)
+		}
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid listener port %d", port)
+		}
+		if port == 0 {
+			port = defaultListenerPort
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		return SetUrl(fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(port))))(l)
+	}
+}
+
+// UpdateURL changes the listener url while the sender is running,
+// a drain in progress sends each request either to the old or to the new url
+func (l *LogzioSender) UpdateURL(listenerURL string) error {
+	u, err := url.Parse(listenerURL)
+	if err != nil {
+		return fmt.Errorf("invalid listener url %s: %v", listenerURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid listener url %s: scheme and host are required", listenerURL)
+	}
+	l.url.Store(l.listenerURL(listenerURL))
+	l.infoLog("logziosender.go: Updating url to %s\n", redactedURL(l.url.Load()))
+	return nil
+}
+
+// listenerURL reads the query params under the config lock, UpdateURL may run during a Reconfigure
+func (l *LogzioSender) listenerURL(host string) string {
+	l.configMux.RLock()
+	defer l.configMux.RUnlock()
+	return withQueryParams(fmt.Sprintf("%s/?token=%s", host, l.token), l.queryParams)
+}
+
+// redactedURL is the listener url without its token, for the debug messages
+func redactedURL(listenerURL string) string {
+	u, err := url.Parse(listenerURL)
+	if err != nil {
+		return listenerURL
+	}
+	params := u.Query()
+	if _, ok := params["token"]; !ok {
+		return listenerURL
+	}
+	params.Del("token")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// redactedError is err without the token of the url of a *url.Error
+func redactedError(err error) error {
+	if e, ok := err.(*url.Error); ok {
+		return &url.Error{Op: e.Op, URL: redactedURL(e.URL), Err: e.Err}
+	}
+	return err
+}
+
+// SetQueryParam adds a query param to the listener url next to the token, it can be repeated
+func SetQueryParam(key, value string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if key == "" || key == "token" {
+			return fmt.Errorf("invalid query param %q", key)
+		}
+		if l.queryParams == nil {
+			l.queryParams = url.Values{}
+		}
+		l.queryParams.Add(key, value)
+		l.url.Store(withQueryParams(l.url.Load(), url.Values{key: {value}}))
 		return nil
 	}
 }
 
+func withQueryParams(listenerURL string, params url.Values) string {
+	if len(params) == 0 {
+		return listenerURL
+	}
+	u, err := url.Parse(listenerURL)
+	if err != nil {
+		return listenerURL
+	}
+	q := u.Query()
+	for key, values := range params {
+		for _, v := range values {
+			q.Add(key, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
 // SetDebug mode and send logs to this writer
 func SetDebug(debug io.Writer) SenderOptionFunc {
 	return func(l *LogzioSender) error {
@@ -136,210 +530,2016 @@ func SetDebug(debug io.Writer) SenderOptionFunc {
 	}
 }
 
+// SetName of the sender, the debug and error logs of the sender start with [name]
+func SetName(name string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.name = name
+		return nil
+	}
+}
+
+// SetStructuredDebug to write the debug logs as one JSON object per line: {"level":"debug","msg":...,"fields":{...}}
+func SetStructuredDebug(structured bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.structuredDebug = structured
+		return nil
+	}
+}
+
 // SetDrainDuration to change the interval between drains
 func SetDrainDuration(duration time.Duration) SenderOptionFunc {
 	return func(l *LogzioSender) error {
+		if duration <= 0 {
+			return fmt.Errorf("invalid drain duration %v, it must be positive", duration)
+		}
 		l.drainDuration = duration
 		return nil
 	}
 }
 
-// SetCheckDiskSpace to check if it crosses the maximum allowed disk usage
-func SetCheckDiskSpace(check bool) SenderOptionFunc {
+// SetMaxDrainDuration to bound a single drain, retries included, to d. The logs not sent in time
+// stay queued for the next drain. Zero, the default, doesn't bound the drain
+func SetMaxDrainDuration(d time.Duration) SenderOptionFunc {
 	return func(l *LogzioSender) error {
-		l.checkDiskSpace = check
+		if d < 0 {
+			return fmt.Errorf("invalid max drain duration %v", d)
+		}
+		l.maxDrainTime = d
 		return nil
 	}
 }
 
-// SetDrainDiskThreshold to change the maximum used disk space
-func SetDrainDiskThreshold(th int) SenderOptionFunc {
+// SetMaxLifetime to stop the sender after d with a final drain, in case Stop is never called
+func SetMaxLifetime(d time.Duration) SenderOptionFunc {
 	return func(l *LogzioSender) error {
-		l.diskThreshold = float32(th)
+		if d <= 0 {
+			return fmt.Errorf("invalid max lifetime %v, it must be positive", d)
+		}
+		l.maxLifetime = d
 		return nil
 	}
 }
 
-func (l *LogzioSender) isEnoughDiskSpace() {
-	for {
-		<-time.After(l.checkDiskDuration)
-		if l.checkDiskSpace {
-			diskStat, err := disk.Usage(l.dir)
-			if err != nil {
-				l.debugLog("logziosender.go: failed to get disk usage: %v\n", err)
-				l.checkDiskSpace = false
-				return
-			}
-
-			usage := float32(diskStat.UsedPercent)
-			if usage > l.diskThreshold {
-				l.debugLog("Logz.io: Dropping logs, as FS used space on %s is %g percent,"+
-					" and the drop threshold is %g percent\n",
-					l.dir, usage, l.diskThreshold)
-				l.fullDisk = true
-			} else {
-				l.fullDisk = false
-			}
-		} else {
-			l.fullDisk = false
+// SetStartupJitter delays the first drain by a random duration in [0, max)
+func SetStartupJitter(max time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if max < 0 {
+			return fmt.Errorf("invalid startup jitter %v", max)
 		}
+		l.startupJitter = max
+		return nil
 	}
 }
 
-// Send the payload to logz.io
-func (l *LogzioSender) Send(payload []byte) error {
-	if !l.fullDisk {
-		_, err := l.queue.Enqueue(payload)
-		return err
+// SetVerifyOnStart to make New fail when the listener is unreachable or rejects the token
+func SetVerifyOnStart(verify bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.verifyOnStart = verify
+		return nil
 	}
-	return nil
 }
 
-func (l *LogzioSender) start() {
-	l.drainTimer()
+// SetSplitLines to enqueue each line of a Write as a separate log, blank lines are skipped like
+// blank logs, see SetSkipEmpty
+func SetSplitLines(split bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.splitLines = split
+		return nil
+	}
 }
 
-// Stop will close the LevelDB queue and do a final drain
-func (l *LogzioSender) Stop() {
-	defer l.queue.Close()
-	l.Drain()
-
+// SetFullPolicy to choose between dropping the incoming log or the oldest queued logs when the queue is full
+func SetFullPolicy(policy FullPolicy) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if policy != DropNewest && policy != DropOldest {
+			return fmt.Errorf("invalid full policy %d", policy)
+		}
+		l.fullPolicy = policy
+		return nil
+	}
 }
 
-func (l *LogzioSender) tryToSendLogs() int {
-	resp, err := l.httpClient.Post(l.url, "text/plain", l.buf)
-	if err != nil {
-		l.debugLog("logziosender.go: Error sending logs to %s %s\n", l.url, err)
-		return httpError
+// SetMaxRequestBytes to split a batch in several requests so each request body,
+// after compression, is at most size bytes. A single log larger than size is dropped
+func SetMaxRequestBytes(size int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if size < 0 {
+			return fmt.Errorf("invalid max request bytes %d", size)
+		}
+		l.maxRequestBytes = size
+		return nil
 	}
+}
 
-	defer resp.Body.Close()
-	statusCode := resp.StatusCode
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		l.debugLog("Error reading response body: %v", err)
-	}
-	if statusCode != http.StatusOK {
-		l.debugLog("got error response from server: ", string(body))
+// SetContentType of the requests to the listener, e.g. application/json or application/x-ndjson
+func SetContentType(contentType string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid content type %q", contentType)
+		}
+		l.contentType = contentType
+		return nil
 	}
-	return statusCode
 }
 
-func (l *LogzioSender) drainTimer() {
-	for {
-		time.Sleep(l.drainDuration)
-		l.Drain()
+// SetHTTPMethod of the requests to the listener, POST or PUT, the default is POST
+func SetHTTPMethod(method string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		switch m := strings.ToUpper(method); m {
+		case http.MethodPost, http.MethodPut:
+			l.httpMethod = m
+			return nil
+		}
+		return fmt.Errorf("invalid http method %q", method)
 	}
 }
 
-func (l *LogzioSender) shouldRetry(attempt int, statusCode int) bool {
-	retry := true
-	switch statusCode {
-	case http.StatusBadRequest:
-		retry = false
-	case http.StatusUnauthorized:
-		retry = false
-	case http.StatusOK:
-		retry = false
+// SetRequestDecorator called with each request to the listener before it is sent, e.g. to inject trace headers.
+// The request context is the one given to DrainContext
+func SetRequestDecorator(decorator func(req *http.Request)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.requestDecorator = decorator
+		return nil
 	}
+}
 
-	if retry && attempt == (sendRetries-1) {
-		l.requeue()
+// SetRequestInterceptor called with each request to the listener after the request decorator, e.g. to
+// sign the request. req.GetBody returns the body unless SetStreamCompression is used. An error fails the
+// request without sending it, like a network error it is retried by the retry policy then requeued
+func SetRequestInterceptor(interceptor func(req *http.Request) error) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.interceptor = interceptor
+		return nil
 	}
-	return retry
 }
 
-// Drain - Send remaining logs
-func (l *LogzioSender) Drain() {
-	if l.draining.Load() {
-		l.debugLog("logziosender.go: Already draining\n")
-		return
+// SetResponseInterceptor called with each response of the listener to the drain requests before its
+// status is checked, e.g. to read a quota header. An error fails the request like a network error,
+// so it is retried by the retry policy, even when the listener accepted the logs
+func SetResponseInterceptor(interceptor func(resp *http.Response) error) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.respInterceptor = interceptor
+		return nil
 	}
-	l.mux.Lock()
-	l.debugLog("logziosender.go: draining queue\n")
-	defer l.mux.Unlock()
-	l.draining.Toggle()
-	defer l.draining.Toggle()
+}
 
-	l.buf.Reset()
-	bufSize := l.dequeueUpToMaxBatchSize()
-	if bufSize > 0 {
-		backOff := sendSleepingBackoff
-		toBackOff := false
-		for attempt := 0; attempt < sendRetries; attempt++ {
-			if toBackOff {
-				l.debugLog("logziosender.go: failed to send logs, trying again in %v\n", backOff)
-				time.Sleep(backOff)
-				backOff *= 2
-			}
-			statusCode := l.tryToSendLogs()
-			if l.shouldRetry(attempt, statusCode) {
-				toBackOff = true
-			} else {
-				break
-			}
-		}
+// prepareRequest applies the request decorator and the request interceptor, read under the config
+// lock as Ping and the warmup don't hold the drain lock
+func (l *LogzioSender) prepareRequest(req *http.Request) error {
+	l.configMux.RLock()
+	decorator, interceptor := l.requestDecorator, l.interceptor
+	l.configMux.RUnlock()
+	if decorator != nil {
+		decorator(req)
 	}
+	if interceptor != nil {
+		return interceptor(req)
+	}
+	return nil
 }
 
-func (l *LogzioSender) dequeueUpToMaxBatchSize() int {
-	var (
-		bufSize int
-		err     error
-	)
-	for bufSize < maxSize && err == nil {
-		item, err := l.queue.Dequeue()
-		if err != nil {
-			l.debugLog("queue state: %s\n", err)
-		}
-		if item != nil {
-			// NewLine is appended tp item.Value
-			if len(item.Value)+bufSize+1 > maxSize {
-				break
-			}
-			bufSize += len(item.Value)
-			l.debugLog("logziosender.go: Adding item %d with size %d (total buffSize: %d)\n",
-				item.ID, len(item.Value), bufSize)
-			_, err := l.buf.Write(append(item.Value, '\n'))
-			if err != nil {
-				l.errorLog("error writing to buffer %s", err)
-			}
-		} else {
-			break
+// requestMethod reads the http method and the content type, Reconfigure may change them
+func (l *LogzioSender) requestMethod() (method, contentType string) {
+	l.configMux.RLock()
+	defer l.configMux.RUnlock()
+	return l.httpMethod, l.contentType
+}
+
+// SetMaxBatchCount to send at most n logs per batch, 0 means no limit besides the batch size
+func SetMaxBatchCount(n int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max batch count %d", n)
 		}
+		l.maxBatchCount = n
+		return nil
 	}
-	return bufSize
 }
 
-// Sync drains the queue
-func (l *LogzioSender) Sync() error {
-	l.Drain()
-	return nil
+// SetMaxInFlightBytes to bound the memory held by the batches being sent, the batch buffer plus
+// its compressed copy. The senders created with the same option, such as those of a Manager, share
+// the bound: a drain waits for the batches of the others before building its batch.
+// A single log larger than the bound is still sent alone
+func SetMaxInFlightBytes(n uint64) SenderOptionFunc {
+	var budget *byteBudget
+	if n > 0 {
+		budget = newByteBudget(n)
+	}
+	return func(l *LogzioSender) error {
+		l.maxInFlightBytes = n
+		l.inFlight = budget
+		return nil
+	}
 }
 
-func (l *LogzioSender) requeue() {
-	l.debugLog("logziosender.go: Requeue %s", l.buf.String())
-	err := l.Send(l.buf.Bytes())
-	if err != nil {
-		l.errorLog("could not requeue logs %s", err)
+// batchSizeLimit is the max batch size within the in-flight bound
+func (l *LogzioSender) batchSizeLimit() int {
+	if l.maxInFlightBytes == 0 {
+		return maxSize
+	}
+	bound := l.maxInFlightBytes
+	if l.compress {
+		// the compressed body is held with the buffer, it is about the size of the batch at worst
+		bound /= 2
 	}
+	if bound >= maxSize {
+		return maxSize
+	}
+	if bound == 0 {
+		// still send one log per batch
+		return 1
+	}
+	return int(bound)
 }
 
-func (l *LogzioSender) debugLog(format string, a ...interface{}) {
-	if l.debug != nil {
-		fmt.Fprintf(l.debug, format, a...)
+// SetSkipEmpty to skip empty and whitespace only logs instead of sending blank lines, the default
+func SetSkipEmpty(skip bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.keepEmpty = !skip
+		return nil
 	}
 }
 
-func (l *LogzioSender) errorLog(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, a...)
+// isSkipped reports whether payload is blank and blank logs are skipped
+func (l *LogzioSender) isSkipped(payload []byte) bool {
+	return !l.keepEmpty && len(bytes.TrimSpace(payload)) == 0
 }
 
-func (l *LogzioSender) Write(p []byte) (n int, err error) {
-	return len(p), l.Send(p)
+// SetSanitizeUTF8 to replace invalid UTF-8 sequences with U+FFFD before enqueuing,
+// the listener rejects the whole batch of an invalid log
+func SetSanitizeUTF8(sanitize bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.sanitizeUTF8 = sanitize
+		return nil
+	}
 }
 
-// CloseIdleConnections to close all remaining open connections
-func (l *LogzioSender) CloseIdleConnections() {
+// toValidUTF8 replaces each run of invalid UTF-8 bytes with U+FFFD, like bytes.ToValidUTF8 of go 1.13
+func toValidUTF8(p []byte) []byte {
+	if utf8.Valid(p) {
+		return p
+	}
+	valid := make([]byte, 0, len(p)+utf8.UTFMax)
+	invalid := false
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size == 1 {
+			if !invalid {
+				valid = append(valid, "\uFFFD"...)
+				invalid = true
+			}
+		} else {
+			valid = append(valid, p[:size]...)
+			invalid = false
+		}
+		p = p[size:]
+	}
+	return valid
+}
+
+// SetMaxItemsPerCall to reject a SendBatch, or a Write split in lines, of more than n logs, 0 means no limit
+func SetMaxItemsPerCall(n int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max items per call %d", n)
+		}
+		l.maxItemsPerCall = n
+		return nil
+	}
+}
+
+// SetMaxConcurrentSends to let at most n callers of Send, SendNoCopy or Write enqueue at once,
+// the others wait for their turn. 0 means no limit
+func SetMaxConcurrentSends(n int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max concurrent sends %d", n)
+		}
+		l.sendSlots = nil
+		if n > 0 {
+			l.sendSlots = make(chan struct{}, n)
+		}
+		return nil
+	}
+}
+
+// SetFailFastSends to return ErrSendBusy instead of waiting when SetMaxConcurrentSends callers are enqueuing
+func SetFailFastSends(failFast bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.failFastSends = failFast
+		return nil
+	}
+}
+
+// acquireSend waits for a send slot, or fails right away with SetFailFastSends
+func (l *LogzioSender) acquireSend() error {
+	if l.sendSlots == nil {
+		return nil
+	}
+	if !l.failFastSends {
+		l.sendSlots <- struct{}{}
+		return nil
+	}
+	select {
+	case l.sendSlots <- struct{}{}:
+		return nil
+	default:
+		return ErrSendBusy
+	}
+}
+
+func (l *LogzioSender) releaseSend() {
+	if l.sendSlots != nil {
+		<-l.sendSlots
+	}
+}
+
+// SetDrainOnFull to drain the queue, for up to a second, before dropping a log because the queue is full.
+// The disk usage is only checked periodically, so it mostly helps the in-memory queue
+func SetDrainOnFull(drain bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.drainOnFull = drain
+		return nil
+	}
+}
+
+// SetAppendNewline to append a newline to each log in the batch, the default. Turn it off when
+// the logs already end with their own line terminator
+func SetAppendNewline(appendNewline bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.noNewline = !appendNewline
+		return nil
+	}
+}
+
+// SetSynchronous to make Send and SendNoCopy drain the queue right away and return a *SendError when the log
+// was not delivered. A paused sender or an open circuit keeps the log queued and Send returns nil
+func SetSynchronous(synchronous bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.synchronous = synchronous
+		return nil
+	}
+}
+
+// SendError is returned by a synchronous Send when the log was not delivered
+type SendError struct {
+	StatusCode int // see the Status*Error codes for transport errors
+	Requeued   bool
+}
+
+func (e *SendError) Error() string {
+	var cause string
+	switch e.StatusCode {
+	case httpError:
+		cause = "transport error"
+	case dnsError:
+		cause = "dns error"
+	case tlsError:
+		cause = "tls error"
+	default:
+		cause = fmt.Sprintf("status code %d", e.StatusCode)
+	}
+	if e.Requeued {
+		return fmt.Sprintf("logzio: send failed with %s, log kept in the queue", cause)
+	}
+	return fmt.Sprintf("logzio: send failed with %s, log dropped", cause)
+}
+
+// SetCheckDiskSpace to check if it crosses the maximum allowed disk usage
+func SetCheckDiskSpace(check bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.checkDiskSpace = check
+		return nil
+	}
+}
+
+// SetDrainDiskThreshold to change the maximum used disk space
+func SetDrainDiskThreshold(th int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskThreshold = float32(th)
+		return nil
+	}
+}
+
+// SetProxy route requests through this proxy instead of the one from the environment,
+// credentials embedded in the url are sent as Proxy-Authorization
+func SetProxy(proxyURL string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy url %s: %v", proxyURL, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid proxy url %s: scheme and host are required", proxyURL)
+		}
+		if l.sharedTransport {
+			return errProxyWithSharedTransport
+		}
+		l.proxyURL = u
+		l.httpTransport.Proxy = l.proxy
+		return nil
+	}
+}
+
+// SetProxyBasicAuth credentials for a proxy requiring authentication
+func SetProxyBasicAuth(user, pass string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if l.sharedTransport {
+			return errProxyWithSharedTransport
+		}
+		l.proxyAuth = url.UserPassword(user, pass)
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		if l.httpTransport.ProxyConnectHeader == nil {
+			l.httpTransport.ProxyConnectHeader = http.Header{}
+		}
+		// used by the CONNECT request of https listeners
+		l.httpTransport.ProxyConnectHeader.Set("Proxy-Authorization", "Basic "+auth)
+		l.httpTransport.Proxy = l.proxy
+		return nil
+	}
+}
+
+var errProxyWithSharedTransport = errors.New("the proxy of a shared transport is set on the transport")
+
+// SetSharedTransport to send with transport, which may be shared between senders to reuse the connections.
+// The caller owns transport, Stop and CloseIdleConnections of a sender don't close its connections
+func SetSharedTransport(transport *http.Transport) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if transport == nil {
+			return errors.New("nil shared transport")
+		}
+		if l.proxyURL != nil || l.proxyAuth != nil {
+			return errProxyWithSharedTransport
+		}
+		if l.unixSocket != "" {
+			return errUnixSocketWithSharedTransport
+		}
+		if l.minTLSVersion != 0 {
+			return errTLSWithSharedTransport
+		}
+		if l.connectTimeout != 0 {
+			return errConnectTimeoutWithSharedTransport
+		}
+		l.httpTransport = transport
+		l.httpClient.Transport = transport
+		l.sharedTransport = true
+		return nil
+	}
+}
+
+var errTLSWithSharedTransport = errors.New("the TLS version of a shared transport is set on the transport")
+
+// SetMinTLSVersion to change the minimum TLS version of the connections to the listener, such as
+// tls.VersionTLS13. The default is TLS 1.2
+func SetMinTLSVersion(version uint16) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if version < tls.VersionTLS10 {
+			return fmt.Errorf("invalid min TLS version %#x", version)
+		}
+		if l.sharedTransport {
+			return errTLSWithSharedTransport
+		}
+		l.minTLSVersion = version
+		l.httpTransport.TLSClientConfig.MinVersion = version
+		return nil
+	}
+}
+
+var errUnixSocketWithSharedTransport = errors.New("the unix socket of a shared transport is set on the transport")
+
+// SetUnixSocket to send the requests over the unix socket at path instead of tcp, e.g. to a local agent.
+// The host of the listener url is only sent as the Host header, and no proxy is used
+func SetUnixSocket(path string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if path == "" {
+			return fmt.Errorf("invalid unix socket %q", path)
+		}
+		if l.sharedTransport {
+			return errUnixSocketWithSharedTransport
+		}
+		l.unixSocket = path
+		l.setDialContext()
+		l.httpTransport.Proxy = nil
+		return nil
+	}
+}
+
+var errConnectTimeoutWithSharedTransport = errors.New("the connect timeout of a shared transport is set on the transport")
+
+// SetConnectTimeout to fail a request when the connection to the listener isn't established within d,
+// e.g. to detect an unreachable host quickly while keeping the 10 seconds timeout of the whole request
+func SetConnectTimeout(d time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid connect timeout %v", d)
+		}
+		if l.sharedTransport {
+			return errConnectTimeoutWithSharedTransport
+		}
+		l.connectTimeout = d
+		l.setDialContext()
+		return nil
+	}
+}
+
+// setDialContext dials the listener with the connect timeout, over the unix socket if any
+func (l *LogzioSender) setDialContext() {
+	l.dialer = net.Dialer{Timeout: l.connectTimeout}
+	dialer := &l.dialer
+	if l.unixSocket == "" {
+		l.httpTransport.DialContext = dialer.DialContext
+		return
+	}
+	path := l.unixSocket
+	l.httpTransport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+// proxy returns the configured proxy, or the one from the environment, with the basic auth credentials
+func (l *LogzioSender) proxy(req *http.Request) (*url.URL, error) {
+	u := l.proxyURL
+	if u == nil {
+		var err error
+		if u, err = http.ProxyFromEnvironment(req); u == nil || err != nil {
+			return u, err
+		}
+	}
+	if l.proxyAuth == nil {
+		return u, nil
+	}
+	withAuth := *u
+	withAuth.User = l.proxyAuth
+	return &withAuth, nil
+}
+
+// SetDiskUsageFallback to cap the disk queue at maxLogs logs while the disk usage can't be read,
+// instead of disabling the disk usage check. The default 0 disables the check on the first error
+func SetDiskUsageFallback(maxLogs uint64) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskFallbackLogs = maxLogs
+		return nil
+	}
+}
+
+// SetDiskCheckLowWaterMark to skip the disk usage check while the disk queue holds fewer logs
+func SetDiskCheckLowWaterMark(logs uint64) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskLowWaterMark = logs
+		return nil
+	}
+}
+
+func (l *LogzioSender) isEnoughDiskSpace() {
+	for {
+		<-time.After(l.checkDiskDuration)
+		q, inMemory := l.currentQueue()
+		if inMemory {
+			// migrated to the in-memory queue
+			l.fullDisk.Store(false)
+			continue
+		}
+		// a nearly empty queue can't fill the disk
+		if l.checkDiskSpace && q.Length() >= l.diskLowWaterMark {
+			diskStat, err := l.diskUsage(l.dir)
+			if err != nil {
+				if l.diskFallbackLogs == 0 {
+					l.warnLog("logziosender.go: failed to get disk usage of %s, disabling the disk usage check: %v\n", l.dir, err)
+					l.checkDiskSpace = false
+					return
+				}
+				if !l.diskUsageFailed.Swap(true) {
+					l.warnLog("logziosender.go: failed to get disk usage of %s, limiting the disk queue to %d logs: %v\n",
+						l.dir, l.diskFallbackLogs, err)
+				}
+				l.fullDisk.Store(false)
+				continue
+			}
+			l.diskUsageFailed.Store(false)
+
+			// Reconfigure may change the threshold
+			l.configMux.RLock()
+			threshold := l.diskThreshold
+			l.configMux.RUnlock()
+			usage := float32(diskStat.UsedPercent)
+			if usage > threshold {
+				l.warnLog("Logz.io: Dropping logs, as FS used space on %s is %g percent,"+
+					" and the drop threshold is %g percent\n",
+					l.dir, usage, threshold)
+				l.fullDisk.Store(true)
+			} else {
+				l.fullDisk.Store(false)
+			}
+		} else {
+			l.fullDisk.Store(false)
+		}
+	}
+}
+
+// isDiskFull reports whether the disk queue drops logs, by the disk usage or by the
+// SetDiskUsageFallback cap while the usage can't be read
+func (l *LogzioSender) isDiskFull() bool {
+	if l.diskUsageFailed.Load() {
+		return l.queue.Length() >= l.diskFallbackLogs
+	}
+	return l.fullDisk.Load()
+}
+
+// EstimatedCapacity returns how many logs of avgLogSize bytes the in-memory queue holds, the lower of
+// the log count limit and the capacity in bytes. It returns -1 for the disk queue, whose capacity
+// depends on the free disk space
+func (l *LogzioSender) EstimatedCapacity(avgLogSize int) int {
+	if _, inMemory := l.currentQueue(); !inMemory {
+		return -1
+	}
+	if avgLogSize <= 0 {
+		return l.logCountLimit
+	}
+	if logs := l.inMemoryCapacity / uint64(avgLogSize); logs < uint64(l.logCountLimit) {
+		return int(logs)
+	}
+	return l.logCountLimit
+}
+
+// hasRoom reports whether the queue can take logs of dataSize bytes without dropping or evicting logs
+func (l *LogzioSender) hasRoom(dataSize, logs uint64) bool {
+	if !l.inMemoryQueue {
+		return !l.isDiskFull()
+	}
+	return l.queue.Length()+dataSize <= l.inMemoryCapacity && l.queueCount()+logs <= uint64(l.logCountLimit)
+}
+
+// drainForRoom drains the queue, waiting at most drainOnFullTimeout. It doesn't wait for a drain
+// in progress, which also keeps the requeue of a drain from draining again
+func (l *LogzioSender) drainForRoom() {
+	if l.draining.Load() || l.paused.Load() {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		l.Drain()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainOnFullTimeout):
+		l.warnLog("logziosender.go: Drain to free the full queue did not complete in %v\n", drainOnFullTimeout)
+	}
+}
+
+func (l *LogzioSender) isEnoughMemory(dataSize, logs uint64) bool {
+	usage := l.queue.Length()
+	// a log that exactly fills the capacity still fits, like the disk threshold check
+	if usage+dataSize > l.inMemoryCapacity {
+		l.dropLog("logziosender.go: Dropping logs, the in-memory queue holds %d bytes"+
+			" and the capacity is %d bytes\n", usage, l.inMemoryCapacity)
+		return false
+	}
+	if l.queueCount()+logs > uint64(l.logCountLimit) {
+		l.dropLog("logziosender.go: Dropping logs, the in-memory queue reached the limit of %d logs\n", l.logCountLimit)
+		return false
+	}
+	return true
+}
+
+// evictOldest dequeues the oldest logs until the in-memory queue has room for logs of dataSize bytes
+func (l *LogzioSender) evictOldest(dataSize, logs uint64) {
+	if dataSize > l.inMemoryCapacity || logs > uint64(l.logCountLimit) {
+		// can't fit even in an empty queue
+		return
+	}
+	for l.queue.Length()+dataSize > l.inMemoryCapacity || l.queueCount()+logs > uint64(l.logCountLimit) {
+		item, err := l.queue.Dequeue()
+		if err != nil {
+			return
+		}
+		l.enqueueTimes.remove(item.ID)
+		l.dropLog("logziosender.go: Evicting item %d with size %d, the in-memory queue is full\n", item.ID, len(item.Value))
+		l.dropLogs(l.coalesced.remove(item.ID))
+	}
+}
+
+// evictOldestFromDisk dequeues the oldest log of the disk queue, the disk usage is only
+// checked periodically so a full disk queue evicts one log per incoming log
+func (l *LogzioSender) evictOldestFromDisk() bool {
+	item, err := l.queue.Dequeue()
+	if err != nil {
+		return false
+	}
+	l.enqueueTimes.remove(item.ID)
+	l.dropLog("logziosender.go: Evicting item %d, the disk is full\n", item.ID)
+	l.dropLogs(l.coalesced.remove(item.ID))
+	return true
+}
+
+// SetDropLogInterval to write at most one message per d about logs dropped because the queue is full,
+// with the number of drops since the previous message. The default 0 writes a message per drop
+func SetDropLogInterval(d time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if d < 0 {
+			return fmt.Errorf("invalid drop log interval %v", d)
+		}
+		l.dropLogInterval = d
+		return nil
+	}
+}
+
+type dropLogLimit struct {
+	mux        sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// dropLog writes a warning about a dropped log, rate limited by SetDropLogInterval
+func (l *LogzioSender) dropLog(format string, a ...interface{}) {
+	if l.dropLogInterval == 0 {
+		l.warnLog(format, a...)
+		return
+	}
+	d := &l.dropLogLimit
+	now := l.clock.Now()
+	d.mux.Lock()
+	if !d.last.IsZero() && now.Sub(d.last) < l.dropLogInterval {
+		d.suppressed++
+		d.mux.Unlock()
+		return
+	}
+	suppressed := d.suppressed
+	d.last, d.suppressed = now, 0
+	d.mux.Unlock()
+	msg := fmt.Sprintf(format, a...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s, %d more drops since the previous message\n", strings.TrimSuffix(msg, "\n"), suppressed)
+	}
+	l.warnLog("%s", msg)
+}
+
+// dropLogs counts n dropped logs
+func (l *LogzioSender) dropLogs(n int) {
+	l.droppedLogs.Add(uint64(n))
+	l.unreportedDrops.Add(uint64(n))
+}
+
+// setQueueFull fires the queue state callback only when the state changes
+func (l *LogzioSender) setQueueFull(full bool) {
+	if full == l.queueFull.Load() || full == l.queueFull.Swap(full) {
+		return
+	}
+	if l.queueStateFunc != nil {
+		l.queueStateFunc(full)
+	}
+}
+
+// Send the payload to logz.io, a payload dropped because the queue is full is not an error.
+// A blank payload is skipped with ErrEmptyPayload, see SetSkipEmpty
+func (l *LogzioSender) Send(payload []byte) error {
+	return l.sendLog(payload, false)
+}
+
+// sendLog is Send, without copying payload into the in-memory queue when owned is true
+func (l *LogzioSender) sendLog(payload []byte, owned bool) error {
+	if l.stopped.Load() {
+		return ErrSenderClosed
+	}
+	if err := l.acquireSend(); err != nil {
+		return err
+	}
+	defer l.releaseSend()
+	if l.isSkipped(payload) {
+		return ErrEmptyPayload
+	}
+	if l.isDuplicate(payload) {
+		return nil
+	}
+	if err := l.enqueueDeduped(payload, owned); err != ErrQueueFull {
+		if err == nil && l.synchronous {
+			return l.DrainSync()
+		}
+		return err
+	}
+	return nil
+}
+
+// DrainSync drains the queue inline and returns once the attempt completes, unlike Drain it waits for
+// a drain in progress instead of returning right away. It returns a *SendError when a batch was not delivered
+func (l *LogzioSender) DrainSync() error {
+	result := l.drain(context.Background(), true, 0)
+	if result.FailedBatches == 0 {
+		return nil
+	}
+	return &SendError{StatusCode: result.StatusCode, Requeued: result.Requeued > 0}
+}
+
+// SendNoCopy is Send without copying payload into the in-memory queue, the queue keeps payload
+// until it is sent. The caller must not modify payload after the call. The disk queue always copies
+func (l *LogzioSender) SendNoCopy(payload []byte) error {
+	return l.sendLog(payload, true)
+}
+
+// SendBatch sends each payload like Send, it returns ErrTooManyItems without enqueuing any
+// when there are more payloads than SetMaxItemsPerCall allows
+func (l *LogzioSender) SendBatch(payloads [][]byte) error {
+	if l.maxItemsPerCall > 0 && len(payloads) > l.maxItemsPerCall {
+		return ErrTooManyItems
+	}
+	for _, payload := range payloads {
+		if err := l.Send(payload); err != nil && err != ErrEmptyPayload {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalError is returned by SendJSON when the value could not be marshaled, nothing is enqueued
+type MarshalError struct {
+	Err error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("logzio: could not marshal the log: %v", e.Err)
+}
+
+// SendJSON marshals v, with encoding/json unless SetMarshaler is used, and sends it like Send
+func (l *LogzioSender) SendJSON(v interface{}) error {
+	payload, err := l.marshal(v)
+	if err != nil {
+		return &MarshalError{Err: err}
+	}
+	return l.Send(payload)
+}
+
+// SetMarshaler used by SendJSON instead of json.Marshal
+func SetMarshaler(marshal func(v interface{}) ([]byte, error)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if marshal == nil {
+			return errors.New("invalid nil marshaler")
+		}
+		l.marshal = marshal
+		return nil
+	}
+}
+
+// enqueue the payload, it returns ErrQueueFull when the payload is dropped
+func (l *LogzioSender) enqueue(payload []byte) error {
+	return l.enqueueOwned(payload, false)
+}
+
+// enqueueOwned enqueues payload without copying it into the in-memory queue when owned is true
+func (l *LogzioSender) enqueueOwned(payload []byte, owned bool) error {
+	err := l.enqueueItem(payload, owned, nil)
+	if err == ErrQueueFull {
+		l.dropLogs(1)
+	}
+	return err
+}
+
+// enqueueItem enqueues payload holding the logs ending at ends, nil for a single log.
+// The logs are not counted as dropped when the queue is full
+func (l *LogzioSender) enqueueItem(payload []byte, owned bool, ends []int) error {
+	if l.sanitizeUTF8 && ends == nil {
+		// the joined logs were sanitized one by one
+		payload = toValidUTF8(payload)
+	}
+	logs := uint64(1)
+	if ends != nil {
+		logs = uint64(len(ends))
+	}
+	if l.drainOnFull {
+		l.queueSwap.RLock()
+		room := l.hasRoom(uint64(len(payload)), logs)
+		l.queueSwap.RUnlock()
+		if !room {
+			// without the queue lock, a MigrateQueue holding the drain lock would wait for it until the timeout
+			l.drainForRoom()
+		}
+	}
+	l.queueSwap.RLock()
+	defer l.queueSwap.RUnlock()
+	if l.inMemoryQueue {
+		if l.fullPolicy == DropOldest {
+			l.evictOldest(uint64(len(payload)), logs)
+		}
+		if !l.isEnoughMemory(uint64(len(payload)), logs) {
+			l.setQueueFull(true)
+			return ErrQueueFull
+		}
+	} else if l.isDiskFull() && !(l.fullPolicy == DropOldest && l.evictOldestFromDisk()) {
+		l.setQueueFull(true)
+		return ErrQueueFull
+	}
+	enqueue := func() (*goque.Item, error) {
+		q, inMemory := l.queue.(*ConcurrentQueue)
+		switch {
+		case inMemory && owned:
+			return q.EnqueueNoCopy(payload)
+		case !inMemory && l.diskCompress:
+			return l.queue.Enqueue(compressItem(payload))
+		}
+		return l.queue.Enqueue(payload)
+	}
+	var (
+		item *goque.Item
+		err  error
+	)
+	if ends != nil {
+		item, err = l.coalesced.enqueue(ends, enqueue)
+	} else {
+		item, err = enqueue()
+	}
+	if err == nil {
+		l.enqueueTimes.add(item.ID, l.clock.Now())
+		l.setQueueFull(false)
+	}
+	return err
+}
+
+func (l *LogzioSender) start() {
+	if l.warmup {
+		l.warmupConnection()
+	}
+	if l.heartbeatEvery > 0 {
+		go l.sendHeartbeats()
+	}
+	if l.maxLifetime > 0 {
+		go func() {
+			l.clock.Sleep(l.maxLifetime)
+			if !l.stopped.Load() {
+				l.infoLog("logziosender.go: Max lifetime %v reached, stopping\n", l.maxLifetime)
+				l.Stop()
+			}
+		}()
+	}
+	l.drainTimer()
+}
+
+// SetHeartbeat to queue payload every interval, e.g. for dashboards detecting silent hosts.
+// Heartbeats don't go through SetDedup or SetMaxConcurrentSends, they stop with the sender
+func SetHeartbeat(interval time.Duration, payload []byte) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid heartbeat interval %v", interval)
+		}
+		if len(payload) == 0 {
+			return ErrEmptyPayload
+		}
+		l.heartbeatEvery = interval
+		l.heartbeat = append([]byte(nil), payload...)
+		return nil
+	}
+}
+
+func (l *LogzioSender) sendHeartbeats() {
+	for {
+		l.clock.Sleep(l.heartbeatEvery)
+		if l.stopped.Load() {
+			return
+		}
+		if err := l.enqueueLog(l.heartbeat, false); err != nil {
+			l.warnLog("logziosender.go: Error queuing the heartbeat %s\n", err)
+		}
+	}
+}
+
+// SetWarmup to open a connection to the listener when the sender starts, so the first drain
+// doesn't pay for the TLS handshake. The connection goes through the configured transport and proxy
+func SetWarmup(warmup bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.warmup = warmup
+		return nil
+	}
+}
+
+// warmupConnection sends a HEAD request to the listener and leaves the connection idle for the first drain
+func (l *LogzioSender) warmupConnection() {
+	req, err := http.NewRequest(http.MethodHead, l.url.Load(), nil)
+	if err != nil {
+		l.debugLog("logziosender.go: Error creating the warmup request %s\n", err)
+		return
+	}
+	if err := l.prepareRequest(req); err != nil {
+		l.debugLog("logziosender.go: Error intercepting the warmup request %s\n", err)
+		return
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		l.debugLog("logziosender.go: Error warming up the connection %s\n", redactedError(err))
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Stop will close the queue and do a final drain, further logs are rejected with ErrSenderClosed
+func (l *LogzioSender) Stop() {
+	if l.stopped.Swap(true) {
+		return
+	}
+	close(l.stopping)
+	defer l.closeQueue()
+	l.Drain()
+
+}
+
+// StopAsync is Stop with the final drain in the background, the channel gets the result of the
+// drain once the queue is closed: nil, or a *SendError when a batch was not delivered. The final drain
+// waits for a drain in progress. The channel gets ErrSenderClosed when the sender was already stopped
+func (l *LogzioSender) StopAsync() <-chan error {
+	done := make(chan error, 1)
+	if l.stopped.Swap(true) {
+		done <- ErrSenderClosed
+		return done
+	}
+	close(l.stopping)
+	go func() {
+		err := l.DrainSync()
+		l.closeQueue()
+		done <- err
+	}()
+	return done
+}
+
+// Pause stops sending to the listener, logs are still queued up to the queue capacity.
+// Drain, Sync and Stop don't send while paused
+func (l *LogzioSender) Pause() {
+	l.paused.Store(true)
+}
+
+// Resume sending to the listener, the queued logs are drained right away
+func (l *LogzioSender) Resume() {
+	if l.paused.Swap(false) {
+		go l.Drain()
+	}
+}
+
+// Ping sends an empty request to verify the listener is reachable and accepts the token.
+// It returns an *UnreachableError on network errors and ErrUnauthorized on auth errors
+func (l *LogzioSender) Ping() error {
+	method, contentType := l.requestMethod()
+	req, err := http.NewRequest(method, l.url.Load(), bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if err := l.prepareRequest(req); err != nil {
+		return err
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return &UnreachableError{Err: redactedError(err)}
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("logzio: listener responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SetTrimTrailingNewline to send the batches without the newline following the last log, for strict
+// NDJSON parsers. The newline is trimmed before compression, so the Content-Length doesn't include it
+func SetTrimTrailingNewline(trim bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.trimNewline = trim
+		return nil
+	}
+}
+
+func (l *LogzioSender) tryToSendLogs(data []byte) int {
+	if l.trimNewline {
+		data = bytes.TrimSuffix(data, []byte{'\n'})
+	}
+	body, encoding, err := l.requestReader(data)
+	if err != nil {
+		l.errorLog("logziosender.go: Error compressing logs %s\n", err)
+		return httpError
+	}
+	if r, ok := body.(*bytes.Reader); ok && encoding == gzipEncoding {
+		l.recordCompression(len(data), r.Len())
+	}
+	target := l.url.Load()
+	// the messages don't show the token
+	logged := redactedURL(target)
+	method, contentType := l.requestMethod()
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		if c, ok := body.(io.Closer); ok {
+			c.Close()
+		}
+		l.errorLog("logziosender.go: Error creating request to %s %s\n", logged, err)
+		return httpError
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if l.drainCtx != nil {
+		req = req.WithContext(l.drainCtx)
+	}
+	if err := l.prepareRequest(req); err != nil {
+		if c, ok := body.(io.Closer); ok {
+			c.Close()
+		}
+		l.warnLog("logziosender.go: Request to %s failed by the request interceptor %s\n", logged, err)
+		return httpError
+	}
+	start := time.Now()
+	resp, err := l.httpClient.Do(req)
+	latency := time.Since(start)
+	l.recordLatency(latency)
+	l.logEvent(DebugLevelDebug, "request to the listener", map[string]interface{}{"latency": latency.String()})
+	if err != nil {
+		statusCode := classifyTransportError(err)
+		l.warnLog("logziosender.go: Transport error (%s), no response sending logs to %s: %s\n",
+			transportErrorKind(statusCode), logged, redactedError(err))
+		return statusCode
+	}
+
+	defer resp.Body.Close()
+	if l.respInterceptor != nil {
+		if err := l.respInterceptor(resp); err != nil {
+			ioutil.ReadAll(resp.Body)
+			l.warnLog("logziosender.go: Response of %s failed by the response interceptor %s\n", logged, err)
+			return httpError
+		}
+	}
+	l.negotiateEncoding(resp.Header.Get("Accept-Encoding"))
+	statusCode := resp.StatusCode
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		l.warnLog("logziosender.go: Error reading the response body of %s: %v\n", logged, err)
+	}
+	if !l.isSuccess(statusCode) {
+		l.warnLog("logziosender.go: HTTP error %d sending logs to %s: %s\n", statusCode, logged, string(respBody))
+	}
+	return statusCode
+}
+
+// classifyTransportError maps a transport error to httpError, dnsError or tlsError
+func classifyTransportError(err error) int {
+	for err != nil {
+		switch e := err.(type) {
+		case *net.DNSError:
+			if e.Timeout() {
+				return httpError
+			}
+			return dnsError
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError,
+			x509.SystemRootsError, tls.RecordHeaderError:
+			return tlsError
+		case *url.Error:
+			err = e.Err
+			continue
+		case *net.OpError:
+			err = e.Err
+			continue
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = unwrapper.Unwrap()
+	}
+	return httpError
+}
+
+// transportErrorKind names the transport error codes for the debug log
+func transportErrorKind(statusCode int) string {
+	switch statusCode {
+	case dnsError:
+		return "dns"
+	case tlsError:
+		return "tls"
+	}
+	return "connection"
+}
+
+func (l *LogzioSender) drainTimer() {
+	// delay the first drain so senders started together don't drain together
+	l.clock.Sleep(l.startupDelay)
+	for {
+		l.clock.Sleep(l.nextDrainDuration())
+		if l.stopped.Load() {
+			return
+		}
+		l.Drain()
+	}
+}
+
+// SetAlignedDrain to drain at each multiple of window on the clock, e.g. at the top of each minute,
+// instead of every drain duration from the sender start. It replaces the drain duration
+func SetAlignedDrain(window time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if window <= 0 {
+			return fmt.Errorf("invalid drain window %v", window)
+		}
+		l.alignedDrain = window
+		return nil
+	}
+}
+
+// nextDrainDuration reads the drain duration, Reconfigure may change it
+func (l *LogzioSender) nextDrainDuration() time.Duration {
+	l.configMux.RLock()
+	defer l.configMux.RUnlock()
+	if l.alignedDrain > 0 {
+		now := l.clock.Now()
+		return now.Truncate(l.alignedDrain).Add(l.alignedDrain).Sub(now)
+	}
+	if l.drainDuration <= 0 {
+		// never spin draining
+		return defaultDrainDuration
+	}
+	return l.drainDuration
+}
+
+// DrainResult reports what a drain actually did
+type DrainResult struct {
+	SentLogs      int // logs delivered to the listener
+	SentBytes     int // bytes of request bodies delivered to the listener
+	FailedBatches int // batches that were not delivered
+	Requeued      int // logs put back on the queue after a failed batch
+	StatusCode    int // of the last failed batch, see the Status*Error codes for transport errors
+}
+
+// Drain - Send remaining logs
+func (l *LogzioSender) Drain() {
+	l.DrainWithResult()
+}
+
+// DrainWithResult sends remaining logs batch by batch and reports the outcome.
+// It stops at the first batch that fails so requeued logs are not resent in the same drain
+func (l *LogzioSender) DrainWithResult() DrainResult {
+	return l.drain(context.Background(), false, 0)
+}
+
+// DrainContext is DrainWithResult with the requests carrying ctx, the drain stops sending batches once ctx is done
+func (l *LogzioSender) DrainContext(ctx context.Context) DrainResult {
+	return l.drain(ctx, false, 0)
+}
+
+// DrainUpTo sends at most maxBytes of queued logs and returns the number of bytes sent, the other logs
+// stay queued. It returns a *SendError when a batch was not delivered
+func (l *LogzioSender) DrainUpTo(maxBytes int) (int, error) {
+	if maxBytes <= 0 {
+		return 0, fmt.Errorf("invalid drain budget %d", maxBytes)
+	}
+	result := l.drain(context.Background(), false, maxBytes)
+	if result.FailedBatches > 0 {
+		return result.SentBytes, &SendError{StatusCode: result.StatusCode, Requeued: result.Requeued > 0}
+	}
+	return result.SentBytes, nil
+}
+
+// drain returns right away when another drain is in progress, unless wait is true.
+// A positive budget bounds the bytes of logs dequeued by the drain
+func (l *LogzioSender) drain(ctx context.Context, wait bool, budget int) DrainResult {
+	var result DrainResult
+	l.flushWriteBuffer()
+	if l.paused.Load() {
+		l.debugLog("logziosender.go: Paused, not draining\n")
+		return result
+	}
+	if !wait && l.draining.Load() {
+		l.debugLog("logziosender.go: Already draining\n")
+		return result
+	}
+	l.mux.Lock()
+	l.debugLog("logziosender.go: draining queue\n")
+	defer l.mux.Unlock()
+	l.draining.Toggle()
+	defer l.draining.Toggle()
+	l.borrowBuffer()
+	defer l.releaseBuffer()
+	if l.maxDrainTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.maxDrainTime)
+		defer cancel()
+		l.drainDeadline = l.clock.Now().Add(l.maxDrainTime)
+		defer func() { l.drainDeadline = time.Time{} }()
+	}
+	l.drainCtx = ctx
+	defer func() { l.drainCtx = nil }()
+	if !l.breaker.allow(l.clock.Now()) {
+		l.warnLog("logziosender.go: circuit open, keeping logs queued\n")
+		return result
+	}
+	defer func() {
+		if result.SentLogs == 0 && result.FailedBatches == 0 {
+			return
+		}
+		if result.FailedBatches > 0 {
+			l.failedDrains.Inc()
+		} else {
+			l.failedDrains.Store(0)
+		}
+		l.breaker.record(result.FailedBatches > 0, l.clock.Now())
+		l.circuitOpen.Store(l.breaker.isOpen())
+	}()
+
+	progress := newProgressReporter(l.progressFunc)
+	defer progress.close()
+	dequeued := 0
+	// only drain the items queued so far, logs sent during the drain wait for the next one
+	snapshot := int(l.queueCount())
+	// the bytes of the batches held in the in-flight bound, until the next batches are built
+	var inFlight uint64
+	defer func() { l.releaseInFlight(inFlight) }()
+	for ctx.Err() == nil && snapshot > 0 && l.withinDrainDeadline(0) {
+		l.releaseInFlight(inFlight)
+		inFlight = 0
+		l.buf.Reset()
+		l.bufEnds = l.bufEnds[:0]
+		l.bufRequeues = l.bufRequeues[:0]
+		remaining := 0
+		if budget > 0 {
+			if remaining = budget - dequeued; remaining <= 0 {
+				return result
+			}
+		}
+		inFlight = l.acquireInFlight()
+		items := l.dequeueUpToMaxBatchSize(remaining)
+		if items == 0 {
+			return result
+		}
+		inFlight = l.fitInFlight(inFlight, l.buf.Len())
+		snapshot -= items
+		dequeued += l.buf.Len()
+		failed := false
+		batches := l.requestBatches()
+		for i := 0; i < len(batches); i++ {
+			b := batches[i]
+			statusCode, requeued := l.sendBatch(b)
+			if statusCode == http.StatusOK {
+				l.unreportedDrops.Store(0)
+				l.archiveBatch(b.data)
+				result.SentLogs += b.logs()
+				result.SentBytes += len(b.data)
+				progress.report(uint64(result.SentBytes), l.remainingBytes(batches[i+1:]))
+				continue
+			}
+			if statusCode == http.StatusBadRequest {
+				if next := b.nextBisection(); next != nil {
+					batches = append(batches[:i:i], append(next, batches[i+1:]...)...)
+					i--
+					continue
+				}
+				l.reportPoison(b.data, 0, statusCode)
+			}
+			result.FailedBatches++
+			result.StatusCode = statusCode
+			failed = true
+			l.dropLogs(b.logs() - requeued)
+			if requeued > 0 {
+				result.Requeued += requeued
+				// keep the rest of the buffer for the next drain as well, it wasn't sent
+				for _, rest := range batches[i+1:] {
+					kept := l.requeue(rest, false)
+					result.Requeued += kept
+					l.dropLogs(rest.logs() - kept)
+				}
+				return result
+			}
+		}
+		if failed {
+			return result
+		}
+	}
+	return result
+}
+
+// SetArchiveWriter to write a copy of each delivered batch to w, uncompressed and only
+// once the listener accepted it. Writes happen during the drain, w should be fast
+func SetArchiveWriter(w io.Writer) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.archive = w
+		return nil
+	}
+}
+
+func (l *LogzioSender) archiveBatch(data []byte) {
+	if l.archive == nil {
+		return
+	}
+	if _, err := l.archive.Write(data); err != nil {
+		l.errorLog("logziosender.go: Error archiving logs %s\n", err)
+	}
+}
+
+// batch is a part of the buffer holding whole logs, ends are the offsets following each log's newline
+// and requeues the requeue count of each log
+type batch struct {
+	data     []byte
+	ends     []int
+	requeues []int
+	bisect   *bisection // of the rejected batch this batch is part of
+}
+
+func (b batch) logs() int {
+	return len(b.ends)
+}
+
+// requeuesOf returns the requeue count of the log i
+func (b batch) requeuesOf(i int) int {
+	if i < len(b.requeues) {
+		return b.requeues[i]
+	}
+	return 0
+}
+
+// byLine returns the batch with a log per line, a requeued item holds several lines
+func (b batch) byLine() batch {
+	lines := batch{data: b.data, ends: make([]int, 0, len(b.ends)), requeues: make([]int, 0, len(b.ends))}
+	item := 0
+	addLine := func(end int) {
+		for item < len(b.ends)-1 && b.ends[item] < end {
+			item++
+		}
+		lines.ends = append(lines.ends, end)
+		lines.requeues = append(lines.requeues, b.requeuesOf(item))
+	}
+	for i, c := range b.data {
+		if c == '\n' {
+			addLine(i + 1)
+		}
+	}
+	if len(lines.ends) == 0 || lines.ends[len(lines.ends)-1] != len(b.data) {
+		addLine(len(b.data))
+	}
+	return lines
+}
+
+// split the batch in two halves of logs
+func (b batch) split() (batch, batch) {
+	mid := len(b.ends) / 2
+	cut := b.ends[mid-1]
+	first := batch{data: b.data[:cut], ends: b.ends[:mid]}
+	second := batch{data: b.data[cut:], ends: make([]int, 0, len(b.ends)-mid)}
+	for _, end := range b.ends[mid:] {
+		second.ends = append(second.ends, end-cut)
+	}
+	if len(b.requeues) == len(b.ends) {
+		first.requeues, second.requeues = b.requeues[:mid], b.requeues[mid:]
+	}
+	return first, second
+}
+
+// requestBatches splits the buffer in batches whose request body fits in maxRequestBytes
+func (l *LogzioSender) requestBatches() []batch {
+	whole := batch{data: l.buf.Bytes(), ends: l.bufEnds, requeues: l.bufRequeues}
+	if l.maxRequestBytes == 0 {
+		return []batch{whole}
+	}
+	return l.splitToFit(whole, nil)
+}
+
+func (l *LogzioSender) splitToFit(b batch, batches []batch) []batch {
+	body, _, err := l.requestBody(b.data)
+	if err != nil || len(body) <= l.maxRequestBytes {
+		// a compression error fails the request later
+		return append(batches, b)
+	}
+	if b.logs() == 1 {
+		l.errorLog("logziosender.go: dropping log with size %d, its request is larger than %d bytes\n", len(b.data), l.maxRequestBytes)
+		l.dropLogs(1)
+		return batches
+	}
+	first, second := b.split()
+	return l.splitToFit(second, l.splitToFit(first, batches))
+}
+
+func (l *LogzioSender) newBuffer() *bytes.Buffer {
+	size := l.bufferCapacity
+	if size > maxSize {
+		size = maxSize
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
+// borrowBuffer takes the buffer of the drain from the pool if there is one
+func (l *LogzioSender) borrowBuffer() {
+	if l.bufferPool == nil {
+		return
+	}
+	if buf, ok := l.bufferPool.Get().(*bytes.Buffer); ok && buf != nil {
+		l.buf = buf
+		return
+	}
+	l.buf = l.newBuffer()
+}
+
+// releaseBuffer returns the buffer to the pool or shrinks it after the drain
+func (l *LogzioSender) releaseBuffer() {
+	if l.bufferPool == nil {
+		l.shrinkBuffer()
+		return
+	}
+	l.buf.Reset()
+	l.bufferPool.Put(l.buf)
+	l.buf = nil
+}
+
+// shrinkBuffer bounds the steady state memory of the sender after a large drain
+func (l *LogzioSender) shrinkBuffer() {
+	if l.buf.Cap() > l.bufferCapacity {
+		l.debugLog("logziosender.go: Shrinking buffer from %d bytes\n", l.buf.Cap())
+		l.buf = l.newBuffer()
+	}
+}
+
+// sendBatch sends the batch with retries, it returns the last status code and the number of logs requeued
+func (l *LogzioSender) sendBatch(b batch) (int, int) {
+	var statusCode int
+	for attempt := 0; ; attempt++ {
+		statusCode = l.send(b)
+		l.lastStatusCode.Store(int64(statusCode))
+		retry, wait := l.retryPolicy.ShouldRetry(statusCode, attempt)
+		if !retry || (statusCode == http.StatusNotFound && l.noRetryOn404) {
+			break
+		}
+		if !l.withinDrainDeadline(wait) {
+			l.warnLog("logziosender.go: Not retrying past the max drain duration %v\n", l.maxDrainTime)
+			break
+		}
+		l.logEvent(DebugLevelWarn, "failed to send logs, trying again", map[string]interface{}{
+			"status":  statusCode,
+			"attempt": attempt,
+			"wait":    wait.String(),
+		})
+		l.retryWait.Store(int64(wait))
+		l.clock.Sleep(wait)
+		l.retryWait.Store(0)
+	}
+	if statusCode == http.StatusOK || isRejected(statusCode) {
+		return statusCode, 0
+	}
+	// keep the logs for the next drain
+	return statusCode, l.requeue(b, true)
+}
+
+// withinDrainDeadline reports whether waiting d keeps the drain within SetMaxDrainDuration
+func (l *LogzioSender) withinDrainDeadline(d time.Duration) bool {
+	return l.drainDeadline.IsZero() || !l.clock.Now().Add(d).After(l.drainDeadline)
+}
+
+// dequeueUpToMaxBatchSize fills the buffer with queued items and returns the number of items added,
+// a positive budget bounds the size of the buffer
+func (l *LogzioSender) dequeueUpToMaxBatchSize(budget int) int {
+	var (
+		bufSize int
+		count   int
+		limit   = l.batchSizeLimit()
+		newline = 1
+	)
+	if l.noNewline {
+		newline = 0
+	}
+	for bufSize < limit && (l.maxBatchCount == 0 || count < l.maxBatchCount) {
+		// peek first so an item that doesn't fit stays queued for the next batch
+		item, err := l.queue.Peek()
+		if err != nil {
+			l.debugLog("queue state: %s\n", err)
+		}
+		if item == nil {
+			break
+		}
+		value, requeues, requeued := itemLogs(item.Value)
+		ends := l.coalesced.get(item.ID)
+		// on the logs as sent, before the framing changes them
+		value, ends, stale := l.dropStale(value, ends, requeued)
+		if !requeued {
+			// requeued logs were framed by the drain that requeued them
+			value, ends = l.frameLogs(value, ends)
+		}
+		if len(value) > 0 && len(value)+bufSize+newline > limit && count > 0 {
+			break
+		}
+		if len(value) > 0 && budget > 0 && l.buf.Len()+len(value)+newline > budget {
+			break
+		}
+		if item, err = l.queue.Dequeue(); err != nil {
+			l.errorLog("error dequeuing item %s", err)
+			break
+		}
+		if enqueued, ok := l.enqueueTimes.remove(item.ID); ok {
+			l.recordQueueLatency(l.clock.Now().Sub(enqueued))
+		}
+		l.coalesced.remove(item.ID)
+		if stale > 0 {
+			l.dropLog("logziosender.go: Dropping %d logs of item %d older than %v\n", stale, item.ID, l.staleMaxAge)
+			l.dropLogs(stale)
+			if len(value) == 0 {
+				continue
+			}
+		}
+		if len(value)+newline > maxSize {
+			// a single item larger than a batch can never be sent
+			l.errorLog("dropping item %d with size %d larger than the max batch size\n", item.ID, len(value))
+			if ends != nil {
+				l.dropLogs(len(ends))
+			} else {
+				l.dropLogs(1)
+			}
+			continue
+		}
+		bufSize += len(value)
+		count++
+		l.debugLog("logziosender.go: Adding item %d with size %d (total buffSize: %d)\n",
+			item.ID, len(value), bufSize)
+		// no append to value, a SendNoCopy payload may have room for the newline
+		start := l.buf.Len()
+		_, err = l.buf.Write(value)
+		if err == nil && newline > 0 {
+			err = l.buf.WriteByte('\n')
+		}
+		if err != nil {
+			l.errorLog("error writing to buffer %s", err)
+		}
+		// the joined logs end at their newline in the buffer
+		for k := 0; k+1 < len(ends); k++ {
+			l.bufEnds = append(l.bufEnds, start+ends[k]+newline)
+			l.bufRequeues = append(l.bufRequeues, requeues)
+		}
+		l.bufEnds = append(l.bufEnds, l.buf.Len())
+		l.bufRequeues = append(l.bufRequeues, requeues)
+	}
+	return count
+}
+
+// QueueCount returns the number of logs in the queue
+func (l *LogzioSender) QueueCount() uint64 {
+	l.queueSwap.RLock()
+	defer l.queueSwap.RUnlock()
+	return l.queueCount()
+}
+
+// queueCount is QueueCount for the drain and the enqueue, which already keep the queue from being migrated
+func (l *LogzioSender) queueCount() uint64 {
+	extra := l.coalesced.extraLogs()
+	if q, ok := l.queue.(*ConcurrentQueue); ok {
+		return q.Count() + extra
+	}
+	return l.queue.Length() + extra
+}
+
+// PeekQueue returns up to n queued payloads without removing them from the queue
+func (l *LogzioSender) PeekQueue(n int) [][]byte {
+	// hold the drain lock so items aren't dequeued while peeking
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var payloads [][]byte
+	for offset := 0; offset < n; offset++ {
+		item, err := l.queue.PeekByOffset(uint64(offset))
+		if err != nil {
+			break
+		}
+		value, _, _ := itemLogs(item.Value)
+		payload := make([]byte, len(value))
+		copy(payload, value)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+// ExportQueue writes the queued logs to w, one per line, and returns the number of logs written.
+// The logs stay queued unless SetDestructiveExport is used, then each item is removed once written
+func (l *LogzioSender) ExportQueue(w io.Writer) (int, error) {
+	return l.exportQueue(w, l.destructiveExport)
+}
+
+// Checkpoint writes the queued logs to w, one per line, leaving them queued.
+// Pass the written data to SetRestoreFrom to queue the logs again in a new sender
+func (l *LogzioSender) Checkpoint(w io.Writer) error {
+	_, err := l.exportQueue(w, false)
+	return err
+}
+
+func (l *LogzioSender) exportQueue(w io.Writer, destructive bool) (int, error) {
+	// hold the drain lock so items aren't dequeued while exporting
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	logs := 0
+	for offset := uint64(0); ; offset++ {
+		var (
+			item *goque.Item
+			err  error
+		)
+		if destructive {
+			item, err = l.queue.Peek()
+		} else {
+			item, err = l.queue.PeekByOffset(offset)
+		}
+		if err == goque.ErrEmpty || err == goque.ErrOutOfBounds {
+			return logs, nil
+		}
+		if err != nil {
+			return logs, err
+		}
+		value, _, _ := itemLogs(item.Value)
+		if _, err = w.Write(value); err == nil && !l.noNewline {
+			_, err = w.Write([]byte{'\n'})
+		}
+		if err != nil {
+			return logs, err
+		}
+		if l.noNewline {
+			logs += countLines(value)
+		} else {
+			logs += bytes.Count(value, []byte{'\n'}) + 1
+		}
+		if destructive {
+			if _, err = l.queue.Dequeue(); err != nil {
+				return logs, err
+			}
+			l.enqueueTimes.remove(item.ID)
+			l.coalesced.remove(item.ID)
+		}
+	}
+}
+
+// ImportQueue enqueues the logs read from r, one per line, and returns the number of logs enqueued.
+// It stops with ErrQueueFull when the queue is full, the logs after the returned count are not enqueued
+func (l *LogzioSender) ImportQueue(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSize)
+	logs := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if l.isSkipped(line) {
+			continue
+		}
+		if l.noNewline {
+			// the scanner drops the newline, don't write it back in the scanner buffer
+			line = append(line[:len(line):len(line)], '\n')
+		}
+		if err := l.enqueue(line); err != nil {
+			return logs, err
+		}
+		logs++
+	}
+	return logs, scanner.Err()
+}
+
+// SetRestoreFrom to enqueue the logs read from r, one per line, when the sender is created, such as a file written by Checkpoint
+func SetRestoreFrom(r io.Reader) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.restoreFrom = r
+		return nil
+	}
+}
+
+// SetDestructiveExport to remove the logs from the queue when ExportQueue writes them
+func SetDestructiveExport(destructive bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.destructiveExport = destructive
+		return nil
+	}
+}
+
+// Sync drains the queue
+func (l *LogzioSender) Sync() error {
+	l.Drain()
+	return nil
+}
+
+// requeue puts the logs of the batch back on the queue, those of a sent batch count one more requeue.
+// The following logs with the same requeue count go back as one item. It returns the number of logs
+// requeued, the others were dropped after the max requeues
+func (l *LogzioSender) requeue(b batch, sent bool) int {
+	requeued := 0
+	start, from := 0, 0
+	for i, end := range b.ends {
+		if i+1 < len(b.ends) && b.requeuesOf(i+1) == b.requeuesOf(i) {
+			continue
+		}
+		requeues := b.requeuesOf(i)
+		if sent {
+			requeues++
+		}
+		var ends []int
+		if i > start {
+			// the logs stay apart in the requeued item, without the newline trimmed by requeueLogs
+			newline := 1
+			if l.noNewline {
+				newline = 0
+			}
+			for _, e := range b.ends[start : i+1] {
+				ends = append(ends, e-from-newline)
+			}
+		}
+		if l.requeueLogs(b.data[from:end], requeues, ends) {
+			requeued += i + 1 - start
+		}
+		start, from = i+1, end
+	}
+	return requeued
+}
+
+// requeueLogs puts data back on the queue as one item holding the logs ending at ends, it returns
+// false when the logs were dropped after the max requeues or couldn't be queued
+func (l *LogzioSender) requeueLogs(data []byte, requeues int, ends []int) bool {
+	if l.dropPoison(data, requeues) {
+		return false
+	}
+	l.debugLog("logziosender.go: Requeue %s", string(data))
+	if !l.noNewline {
+		// the newline of the last log is appended again by the next drain
+		data = bytes.TrimSuffix(data, []byte{'\n'})
+	}
+	if l.maxRequeues > 0 || l.framesLines() {
+		// the header also keeps the requeued logs from being framed again
+		data = withRequeues(data, requeues)
+	}
+	if err := l.enqueueItem(data, false, ends); err != nil {
+		l.errorLog("could not requeue logs %s\n", err)
+		return false
+	}
+	return true
+}
+
+// DebugLevel of the messages written to the debug writer
+type DebugLevel int
+
+// Debug levels, each level includes the ones before it
+const (
+	DebugLevelError DebugLevel = iota
+	DebugLevelWarn
+	DebugLevelInfo
+	// DebugLevelDebug includes the per log messages, it is the default
+	DebugLevelDebug
+)
+
+func (level DebugLevel) String() string {
+	switch level {
+	case DebugLevelError:
+		return "error"
+	case DebugLevelWarn:
+		return "warn"
+	case DebugLevelInfo:
+		return "info"
+	}
+	return "debug"
+}
+
+// SetDebugLevel to only write the messages at level or above to the debug writer
+func SetDebugLevel(level DebugLevel) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if level < DebugLevelError || level > DebugLevelDebug {
+			return fmt.Errorf("invalid debug level %d", level)
+		}
+		l.debugLevel = level
+		return nil
+	}
+}
+
+func (l *LogzioSender) debugLog(format string, a ...interface{}) {
+	l.logf(DebugLevelDebug, format, a...)
+}
+
+func (l *LogzioSender) infoLog(format string, a ...interface{}) {
+	l.logf(DebugLevelInfo, format, a...)
+}
+
+func (l *LogzioSender) warnLog(format string, a ...interface{}) {
+	l.logf(DebugLevelWarn, format, a...)
+}
+
+// debugWriter reads the debug writer of the messages at level, nil when they are not written.
+// Reconfigure may change the debug writer and level
+func (l *LogzioSender) debugWriter(level DebugLevel) io.Writer {
+	l.configMux.RLock()
+	defer l.configMux.RUnlock()
+	if level > l.debugLevel {
+		return nil
+	}
+	return l.debug
+}
+
+func (l *LogzioSender) logf(level DebugLevel, format string, a ...interface{}) {
+	debug := l.debugWriter(level)
+	if debug == nil {
+		return
+	}
+	if l.structuredDebug {
+		msg := strings.TrimSpace(strings.TrimPrefix(fmt.Sprintf(format, a...), "logziosender.go: "))
+		l.logEvent(level, msg, nil)
+		return
+	}
+	io.WriteString(debug, l.namePrefix()+fmt.Sprintf(format, a...))
+}
+
+// namePrefix of the debug lines of a named sender
+func (l *LogzioSender) namePrefix() string {
+	if l.name == "" {
+		return ""
+	}
+	return "[" + l.name + "] "
+}
+
+type debugEntry struct {
+	Sender string                 `json:"sender,omitempty"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// logEvent writes msg with fields, as key=value pairs unless the debug logs are structured
+func (l *LogzioSender) logEvent(level DebugLevel, msg string, fields map[string]interface{}) {
+	debug := l.debugWriter(level)
+	if debug == nil {
+		return
+	}
+	if l.structuredDebug {
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		line, err := json.Marshal(debugEntry{Sender: l.name, Level: level.String(), Msg: msg, Fields: fields})
+		if err != nil {
+			line, _ = json.Marshal(debugEntry{Sender: l.name, Level: level.String(), Msg: msg, Fields: map[string]interface{}{"error": err.Error()}})
+		}
+		debug.Write(append(line, '\n'))
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%slogziosender.go: %s", l.namePrefix(), msg)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	b.WriteString("\n")
+	io.WriteString(debug, b.String())
+}
+
+// errorLog writes to stderr and to the debug writer
+func (l *LogzioSender) errorLog(format string, a ...interface{}) {
+	io.WriteString(os.Stderr, l.namePrefix()+fmt.Sprintf(format, a...))
+	if l.debugWriter(DebugLevelError) != os.Stderr {
+		l.logf(DebugLevelError, format, a...)
+	}
+}
+
+// Write enqueues p as one log, or one log per line with SetSplitLines.
+// Each Write holds whole lines, a last line without a newline is not kept for the next Write.
+// When the queue is full Write returns the bytes enqueued so far and ErrQueueFull,
+// a Write of more lines than SetMaxItemsPerCall allows is rejected with ErrTooManyItems
+func (l *LogzioSender) Write(p []byte) (n int, err error) {
+	if l.stopped.Load() {
+		return 0, ErrSenderClosed
+	}
+	if err := l.acquireSend(); err != nil {
+		return 0, err
+	}
+	defer l.releaseSend()
+	if !l.splitLines {
+		if l.isSkipped(p) || l.isDuplicate(p) {
+			return len(p), nil
+		}
+		if err := l.enqueueDeduped(p, false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if l.maxItemsPerCall > 0 && countLines(p) > l.maxItemsPerCall {
+		return 0, ErrTooManyItems
+	}
+	for n < len(p) {
+		line := p[n:]
+		next := len(p)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+			next = n + i + 1
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if !l.isSkipped(line) && !l.isDuplicate(line) {
+			if err := l.enqueueDeduped(line, false); err != nil {
+				return n, err
+			}
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// countLines of p, including a last line without a newline
+func countLines(p []byte) int {
+	lines := bytes.Count(p, []byte{'\n'})
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// CloseIdleConnections to close all remaining open connections, except those of a shared transport
+func (l *LogzioSender) CloseIdleConnections() {
+	if l.sharedTransport {
+		return
+	}
 	l.httpTransport.CloseIdleConnections()
 }
@@ -0,0 +1,76 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import "sync"
+
+// Manager keeps one sender per token, e.g. one per tenant
+type Manager struct {
+	mux     sync.Mutex
+	senders map[string]*LogzioSender
+	options []SenderOptionFunc
+}
+
+// NewManager creates a manager whose senders are created with options, followed by the options given to GetOrCreate.
+// Each disk queue needs its own directory, don't share SetTempDirectory between tokens
+func NewManager(options ...SenderOptionFunc) *Manager {
+	return &Manager{senders: map[string]*LogzioSender{}, options: options}
+}
+
+// GetOrCreate returns the sender of token, creating it with options if there is none yet
+func (m *Manager) GetOrCreate(token string, options ...SenderOptionFunc) (*LogzioSender, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if l, ok := m.senders[token]; ok {
+		return l, nil
+	}
+	all := make([]SenderOptionFunc, 0, len(m.options)+len(options))
+	all = append(all, m.options...)
+	all = append(all, options...)
+	l, err := New(token, all...)
+	if err != nil {
+		return nil, err
+	}
+	m.senders[token] = l
+	return l, nil
+}
+
+// Stop drains and stops the sender of token, a later GetOrCreate creates a new sender
+func (m *Manager) Stop(token string) {
+	m.mux.Lock()
+	l, ok := m.senders[token]
+	delete(m.senders, token)
+	m.mux.Unlock()
+	if ok {
+		l.Stop()
+	}
+}
+
+// StopAll drains and stops all the senders in parallel
+func (m *Manager) StopAll() {
+	m.mux.Lock()
+	senders := m.senders
+	m.senders = map[string]*LogzioSender{}
+	m.mux.Unlock()
+	var wg sync.WaitGroup
+	for _, l := range senders {
+		wg.Add(1)
+		go func(l *LogzioSender) {
+			defer wg.Done()
+			l.Stop()
+		}(l)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,77 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	var mux sync.Mutex
+	sent := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		sent[r.URL.Query().Get("token")] += string(body)
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	m := NewManager(SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+
+	a, err := m.GetOrCreate("tenant-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.GetOrCreate("tenant-a", SetCompress(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != a || a.compress {
+		t.Fatal("sender was not reused")
+	}
+	b, err := m.GetOrCreate("tenant-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == a {
+		t.Fatal("tenants share a sender")
+	}
+	if _, err := m.GetOrCreate("tenant-c", SetFullPolicy(FullPolicy(42))); err == nil {
+		t.Fatal("expected an error for invalid options")
+	}
+
+	a.Send([]byte("a1"))
+	m.Stop("tenant-a")
+	if recreated, _ := m.GetOrCreate("tenant-a"); recreated == a {
+		t.Fatal("stopped sender was reused")
+	}
+	b.Send([]byte("b1"))
+	m.StopAll()
+
+	mux.Lock()
+	defer mux.Unlock()
+	if sent["tenant-a"] != "a1\n" || sent["tenant-b"] != "b1\n" {
+		t.Fatalf("Unexpected logs %q", sent)
+	}
+	if len(m.senders) != 0 {
+		t.Fatalf("%d senders left after StopAll", len(m.senders))
+	}
+}
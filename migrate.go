@@ -0,0 +1,137 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/beeker1121/goque"
+)
+
+// MigrateQueue moves the queued logs to an in-memory queue, or to a disk queue in the queue
+// directory, e.g. to trade durability for speed during an incident. The logs are copied before the
+// new queue replaces the current one: when the new queue can't take them all the current queue is
+// kept, and ErrQueueFull is returned when they exceed the in-memory capacity. A drain in progress
+// completes first, logs sent during the migration wait for it and go to the new queue
+func (l *LogzioSender) MigrateQueue(toInMemory bool) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.queueSwap.Lock()
+	defer l.queueSwap.Unlock()
+	if l.stopped.Load() {
+		return ErrSenderClosed
+	}
+	if l.inMemoryQueue == toInMemory {
+		return nil
+	}
+	var to genericQueue
+	if toInMemory {
+		to = NewConcurrentQueue()
+	} else {
+		q, err := l.openDiskQueue(l.dir)
+		if err != nil {
+			return fmt.Errorf("failed to open disk queue at %s: %v", l.dir, err)
+		}
+		to = q
+	}
+	preexisting := to.Length() > 0
+	ids, err := l.copyQueue(to, toInMemory)
+	if err != nil {
+		to.Close()
+		if !toInMemory && !preexisting {
+			os.RemoveAll(l.dir)
+		}
+		return err
+	}
+	from := l.queue
+	l.queue = to
+	l.inMemoryQueue = toInMemory
+	l.enqueueTimes.rename(ids)
+	l.coalesced.rename(ids)
+	from.Close()
+	if toInMemory {
+		// the logs are in memory now, don't send them again from the disk queue of a later sender
+		if err := os.RemoveAll(l.dir); err != nil {
+			l.warnLog("logziosender.go: Error removing the disk queue at %s %s\n", l.dir, err)
+		}
+	} else {
+		l.startDiskCheck()
+	}
+	l.infoLog("logziosender.go: Migrated %d queued items to the %s queue\n", len(ids), queueKind(toInMemory))
+	return nil
+}
+
+// copyQueue copies the queued items to the queue to, it returns the ids of the copies by the ids of the items
+func (l *LogzioSender) copyQueue(to genericQueue, toInMemory bool) (map[uint64]uint64, error) {
+	ids := make(map[uint64]uint64)
+	for offset := uint64(0); ; offset++ {
+		item, err := l.queue.PeekByOffset(offset)
+		if err == goque.ErrEmpty || err == goque.ErrOutOfBounds {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		logs, requeues, requeued := itemLogs(item.Value)
+		value := logs
+		if requeued {
+			value = withRequeues(logs, requeues)
+		}
+		if toInMemory {
+			if to.Length()+uint64(len(value)) > l.inMemoryCapacity || offset >= uint64(l.logCountLimit) {
+				return nil, ErrQueueFull
+			}
+		} else if l.diskCompress {
+			value = compressItem(value)
+		}
+		copied, err := to.Enqueue(value)
+		if err != nil {
+			return nil, err
+		}
+		ids[item.ID] = copied.ID
+	}
+}
+
+func queueKind(inMemory bool) string {
+	if inMemory {
+		return "in-memory"
+	}
+	return "disk"
+}
+
+// currentQueue returns the queue and whether it is in memory, for readers outside of the drain and the enqueue
+func (l *LogzioSender) currentQueue() (genericQueue, bool) {
+	l.queueSwap.RLock()
+	defer l.queueSwap.RUnlock()
+	return l.queue, l.inMemoryQueue
+}
+
+func (l *LogzioSender) closeQueue() {
+	q, inMemory := l.currentQueue()
+	q.Close()
+	if l.syncOnStop && !inMemory {
+		if err := syncDir(l.dir); err != nil {
+			l.errorLog("logziosender.go: Error syncing the disk queue at %s %s\n", l.dir, err)
+		}
+	}
+}
+
+// startDiskCheck starts checking the disk usage once a disk queue is used
+func (l *LogzioSender) startDiskCheck() {
+	l.diskCheckOnce.Do(func() {
+		go l.isEnoughDiskSpace()
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMigratingSender(t *testing.T, url string, options ...SenderOptionFunc) *LogzioSender {
+	options = append([]SenderOptionFunc{
+		SetUrl(url),
+		SetTempDirectory(fmt.Sprintf("%s/logzio-migrate-%d", os.TempDir(), time.Now().UnixNano())),
+		SetCheckDiskSpace(false),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+	}, options...)
+	l, err := New("fake-token", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func exportedQueue(t *testing.T, l *LogzioSender) string {
+	var out bytes.Buffer
+	if _, err := l.ExportQueue(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestLogzioSender_MigrateQueue(t *testing.T) {
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l := newMigratingSender(t, ts.URL, SetInMemoryQueue(true), SetDiskCompress(true))
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+	for _, log := range []string{"one", "two", "three"} {
+		l.Send([]byte(log))
+	}
+	// a requeued item holding several logs
+	l.queue.Enqueue(withRequeues([]byte("four\nfive"), 1))
+	expected := "one\ntwo\nthree\nfour\nfive\n"
+
+	if err := l.MigrateQueue(false); err != nil {
+		t.Fatal(err)
+	}
+	if l.inMemoryQueue || l.QueueCount() != 4 {
+		t.Fatalf("in memory %t, %d items queued after migrating to disk", l.inMemoryQueue, l.QueueCount())
+	}
+	if _, err := os.Stat(l.dir); err != nil {
+		t.Fatalf("No disk queue: %v", err)
+	}
+	if got := exportedQueue(t, l); got != expected {
+		t.Fatalf("Unexpected disk queue %q", got)
+	}
+	l.Send([]byte("six"))
+
+	if err := l.MigrateQueue(true); err != nil {
+		t.Fatal(err)
+	}
+	if !l.inMemoryQueue || l.QueueCount() != 5 {
+		t.Fatalf("in memory %t, %d items queued after migrating to memory", l.inMemoryQueue, l.QueueCount())
+	}
+	if _, err := os.Stat(l.dir); !os.IsNotExist(err) {
+		t.Fatalf("The disk queue was kept: %v", err)
+	}
+	if err := l.MigrateQueue(true); err != nil {
+		t.Fatalf("Unexpected error migrating to the current queue: %v", err)
+	}
+
+	l.Drain()
+	select {
+	case body := <-bodies:
+		if body != expected+"six\n" {
+			t.Fatalf("Unexpected body %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No logs sent after the migrations")
+	}
+}
+
+func TestLogzioSender_MigrateQueueFull(t *testing.T) {
+	l := newMigratingSender(t, "http://localhost:12345", SetInMemoryCapacity(10))
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+	for _, log := range []string{"12345", "67890", "abcde"} {
+		l.Send([]byte(log))
+	}
+	if err := l.MigrateQueue(true); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull migrating to a small in-memory queue: %v", err)
+	}
+	if l.inMemoryQueue || exportedQueue(t, l) != "12345\n67890\nabcde\n" {
+		t.Fatalf("Unexpected queue after a failed migration, in memory %t", l.inMemoryQueue)
+	}
+
+	l.Stop()
+	if err := l.MigrateQueue(true); err != ErrSenderClosed {
+		t.Fatalf("Expected ErrSenderClosed migrating a stopped sender: %v", err)
+	}
+}
+
+func TestLogzioSender_MigrateQueueWhileSending(t *testing.T) {
+	l := newMigratingSender(t, "http://localhost:12345", SetInMemoryQueue(true), SetDestructiveExport(true))
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+	const logs = 500
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < logs; i++ {
+			if err := l.Send([]byte("blah")); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		if err := l.MigrateQueue(i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if l.QueueCount() != logs {
+		t.Fatalf("%d logs queued, %d sent", l.QueueCount(), logs)
+	}
+	// don't send the logs on Stop
+	l.ExportQueue(ioutil.Discard)
+}
+
+func TestLogzioSender_MigrateQueueWhileDrainingForRoom(t *testing.T) {
+	l := newMigratingSender(t, "http://localhost:12345", SetInMemoryQueue(true), SetInMemoryCapacity(5), SetDrainOnFull(true))
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+	l.Send([]byte("12345"))
+	// a MigrateQueue holds the drain lock, the drain for room waits for it
+	l.mux.Lock()
+	sent := make(chan struct{})
+	go func() {
+		l.Send([]byte("67890"))
+		close(sent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	swapped := make(chan struct{})
+	go func() {
+		l.queueSwap.Lock()
+		l.queueSwap.Unlock()
+		close(swapped)
+	}()
+	select {
+	case <-swapped:
+	case <-time.After(drainOnFullTimeout / 2):
+		t.Error("The queue lock is held while draining for room")
+	}
+	l.mux.Unlock()
+	<-sent
+}
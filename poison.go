@@ -0,0 +1,138 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+// bisectRequestsPerLevel bounds the requests bisecting a rejected batch of n logs to
+// bisectRequestsPerLevel * log2(n), enough to isolate a couple of poison logs
+const bisectRequestsPerLevel = 4
+
+// requeueHeader prefixes the logs of a requeued batch with its requeue count when SetMaxRequeues or
+// the line framing is used
+const requeueHeader = "\x00logzio-requeues:"
+
+// PoisonBatchError is passed to the poison callback when a batch is dropped after too many requeues,
+// or when logs are rejected by the listener with a bad request
+type PoisonBatchError struct {
+	Logs       []byte // newline separated logs of the batch
+	Requeues   int
+	StatusCode int // of the last request, see the Status*Error codes for transport errors
+}
+
+func (e *PoisonBatchError) Error() string {
+	if e.Requeues == 0 {
+		return fmt.Sprintf("dropping logs of %d bytes rejected with status code %d", len(e.Logs), e.StatusCode)
+	}
+	return fmt.Sprintf("dropping batch of %d bytes after %d requeues, last status code %d", len(e.Logs), e.Requeues, e.StatusCode)
+}
+
+// bisection of a batch rejected with a bad request, shared by the parts of the batch
+type bisection struct {
+	requests int
+	limit    int
+}
+
+// nextBisection returns the batches to send after b was rejected with a bad request, or nil to drop b.
+// A batch is sent again first, so it is only bisected when rejected twice in a row, then split in
+// halves until the rejected logs are isolated. The bisection stops after its request limit, e.g. when
+// the listener rejects every request, and the parts rejected since are dropped as they are
+func (b batch) nextBisection() []batch {
+	lines := b.byLine()
+	if lines.logs() < 2 {
+		return nil
+	}
+	if b.bisect == nil {
+		lines.bisect = &bisection{limit: bisectRequestsPerLevel * bits.Len(uint(lines.logs()))}
+		return []batch{lines}
+	}
+	if b.bisect.requests+2 > b.bisect.limit {
+		return nil
+	}
+	b.bisect.requests += 2
+	first, second := lines.split()
+	first.bisect, second.bisect = b.bisect, b.bisect
+	return []batch{first, second}
+}
+
+// SetMaxRequeues to drop a batch that failed again after being requeued max times.
+// The logs count in the dropped logs, the default 0 requeues until the batch is sent
+func SetMaxRequeues(max int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if max < 0 {
+			return fmt.Errorf("invalid max requeues %d", max)
+		}
+		l.maxRequeues = max
+		return nil
+	}
+}
+
+// SetPoisonCallback called by the drain with each batch dropped after the max requeues
+// and with the logs rejected with a bad request
+func SetPoisonCallback(callback func(err *PoisonBatchError)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.poisonFunc = callback
+		return nil
+	}
+}
+
+// withRequeues prefixes data with the requeue header
+func withRequeues(data []byte, requeues int) []byte {
+	header := requeueHeader + strconv.Itoa(requeues) + "\n"
+	v := make([]byte, 0, len(header)+len(data))
+	return append(append(v, header...), data...)
+}
+
+// stripRequeues returns the logs of a queued item, how many times they were requeued and whether
+// the item is a requeued batch
+func stripRequeues(value []byte) ([]byte, int, bool) {
+	if !bytes.HasPrefix(value, []byte(requeueHeader)) {
+		return value, 0, false
+	}
+	rest := value[len(requeueHeader):]
+	end := bytes.IndexByte(rest, '\n')
+	if end < 0 {
+		return value, 0, false
+	}
+	requeues, err := strconv.Atoi(string(rest[:end]))
+	if err != nil {
+		return value, 0, false
+	}
+	return rest[end+1:], requeues, true
+}
+
+// dropPoison reports whether the batch failed too many times to be requeued again
+func (l *LogzioSender) dropPoison(data []byte, requeues int) bool {
+	if l.maxRequeues == 0 || requeues <= l.maxRequeues {
+		return false
+	}
+	l.reportPoison(data, requeues-1, int(l.lastStatusCode.Load()))
+	return true
+}
+
+// reportPoison counts the dropped batch and passes it to the poison callback
+func (l *LogzioSender) reportPoison(data []byte, requeues int, statusCode int) {
+	err := &PoisonBatchError{Logs: data, Requeues: requeues, StatusCode: statusCode}
+	l.errorLog("logziosender.go: %s\n", err)
+	l.poisonBatches.Inc()
+	if l.poisonFunc != nil {
+		l.poisonFunc(err)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetMaxRequeues_Invalid(t *testing.T) {
+	if _, err := New("fake-token", SetMaxRequeues(-1)); err == nil {
+		t.Fatal("Expected an error for negative max requeues")
+	}
+}
+
+func TestMaxRequeues_DropsPoisonBatch(t *testing.T) {
+	for _, inMemory := range []bool{true, false} {
+		var (
+			mux    sync.Mutex
+			bodies []string
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mux.Lock()
+			bodies = append(bodies, string(body))
+			mux.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		var poisoned []*PoisonBatchError
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetInMemoryQueue(inMemory),
+			SetTempDirectory(fmt.Sprintf("%s/logzio-poison-%d", os.TempDir(), time.Now().UnixNano())),
+			SetCheckDiskSpace(false),
+			SetRetryPolicy(noRetryPolicy{}),
+			SetDrainDuration(time.Hour),
+			SetMaxRequeues(2),
+			SetPoisonCallback(func(err *PoisonBatchError) {
+				poisoned = append(poisoned, err)
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("a"))
+		l.Send([]byte("b"))
+
+		for i := 0; i < 2; i++ {
+			// the requeued logs are queued as a single item
+			if res := l.DrainWithResult(); res.Requeued == 0 {
+				t.Fatalf("in memory %t: unexpected result of drain %d %+v", inMemory, i, res)
+			}
+			if peek := l.PeekQueue(1); len(peek) != 1 || string(peek[0]) != "a\nb" {
+				t.Fatalf("in memory %t: unexpected queued payloads %q", inMemory, peek)
+			}
+		}
+		res := l.DrainWithResult()
+		if res.Requeued != 0 || res.FailedBatches != 1 {
+			t.Fatalf("in memory %t: unexpected result of the last drain %+v", inMemory, res)
+		}
+		if l.QueueCount() != 0 {
+			t.Fatalf("in memory %t: %d items still queued", inMemory, l.QueueCount())
+		}
+		for _, body := range bodies {
+			if body != "a\nb\n" {
+				t.Fatalf("in memory %t: unexpected request body %q", inMemory, body)
+			}
+		}
+		if len(bodies) != 3 {
+			t.Fatalf("in memory %t: %d requests", inMemory, len(bodies))
+		}
+		if len(poisoned) != 1 {
+			t.Fatalf("in memory %t: %d poison callbacks", inMemory, len(poisoned))
+		}
+		if p := poisoned[0]; string(p.Logs) != "a\nb\n" || p.Requeues != 2 || p.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("in memory %t: unexpected poison batch %+v", inMemory, p)
+		}
+		if m := l.Metrics(); m.PoisonBatches != 1 || m.DroppedLogs == 0 {
+			t.Fatalf("in memory %t: unexpected metrics %+v", inMemory, m)
+		}
+		l.Stop()
+		os.RemoveAll(l.dir)
+		ts.Close()
+	}
+}
+
+func TestMaxRequeues_CountsPerLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	var poisoned []string
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+		SetMaxRequeues(1),
+		SetPoisonCallback(func(err *PoisonBatchError) {
+			poisoned = append(poisoned, string(err.Logs))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("old"))
+	l.Drain()
+	// a fresh log batched with a requeued one keeps its own count
+	l.Send([]byte("fresh"))
+	if res := l.DrainWithResult(); res.Requeued != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if len(poisoned) != 1 || poisoned[0] != "old\n" {
+		t.Fatalf("Expected only the old log to be dropped, got %q", poisoned)
+	}
+	if peek := l.PeekQueue(2); len(peek) != 1 || string(peek[0]) != "fresh" {
+		t.Fatalf("Unexpected queued payloads %q", peek)
+	}
+	l.Drain()
+	if len(poisoned) != 2 || poisoned[1] != "fresh\n" {
+		t.Fatalf("Expected the fresh log to be dropped after its second failure, got %q", poisoned)
+	}
+}
+
+func TestMaxRequeues_UnsentBatchNotCounted(t *testing.T) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	var poisoned []string
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+		SetMaxRequestBytes(2),
+		SetMaxRequeues(1),
+		SetPoisonCallback(func(err *PoisonBatchError) {
+			poisoned = append(poisoned, string(err.Logs))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("a"))
+	l.Send([]byte("b"))
+	// b is requeued without being sent
+	l.Drain()
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("Expected a single request, got %d", n)
+	}
+	l.Drain()
+	if len(poisoned) != 1 || poisoned[0] != "a\n" {
+		t.Fatalf("Expected only the log sent twice to be dropped, got %q", poisoned)
+	}
+	if peek := l.PeekQueue(2); len(peek) != 1 || string(peek[0]) != "b" {
+		t.Fatalf("Unexpected queued payloads %q", peek)
+	}
+}
+
+func TestStripRequeues(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		logs     string
+		requeues int
+		requeued bool
+	}{
+		{"blah", "blah", 0, false},
+		{string(withRequeues([]byte("a\nb"), 3)), "a\nb", 3, true},
+		{string(withRequeues([]byte("a\nb"), 0)), "a\nb", 0, true},
+		{requeueHeader + "x\nblah", requeueHeader + "x\nblah", 0, false},
+		{requeueHeader + "1", requeueHeader + "1", 0, false},
+	} {
+		logs, requeues, requeued := stripRequeues([]byte(tc.value))
+		if string(logs) != tc.logs || requeues != tc.requeues || requeued != tc.requeued {
+			t.Fatalf("stripRequeues(%q) = %q, %d, %t", tc.value, logs, requeues, requeued)
+		}
+	}
+}
+
+func TestBadRequest_BisectsPoisonLog(t *testing.T) {
+	var (
+		mux       sync.Mutex
+		delivered []string
+		requests  int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		defer mux.Unlock()
+		requests++
+		if bytes.Contains(body, []byte("poison")) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delivered = append(delivered, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")...)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var poisoned []*PoisonBatchError
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetPoisonCallback(func(err *PoisonBatchError) {
+			poisoned = append(poisoned, err)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	for _, log := range []string{"good1", "good2", "poison", "good3", "good4"} {
+		l.Send([]byte(log))
+	}
+	res := l.DrainWithResult()
+	if res.SentLogs != 4 || res.FailedBatches != 1 || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	sort.Strings(delivered)
+	if strings.Join(delivered, ",") != "good1,good2,good3,good4" {
+		t.Fatalf("Unexpected delivered logs %q", delivered)
+	}
+	if len(poisoned) != 1 || string(poisoned[0].Logs) != "poison\n" || poisoned[0].StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected poison logs %+v", poisoned)
+	}
+	if m := l.Metrics(); m.DroppedLogs != 1 || m.PoisonBatches != 1 || m.QueuedLogs != 0 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+	// all 5 logs twice, then 2 and 3 logs, then the poison log and the 2 logs after it
+	if requests != 6 {
+		t.Fatalf("%d requests", requests)
+	}
+
+	// the lines of a requeued item are bisected as well
+	l.queue.Enqueue([]byte("good5\npoison"))
+	if res := l.DrainWithResult(); res.SentLogs != 1 || res.FailedBatches != 1 {
+		t.Fatalf("Unexpected result for a multi line item %+v", res)
+	}
+}
+
+func TestBadRequest_ListenerRejectsEverything(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	var poisoned []*PoisonBatchError
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetPoisonCallback(func(err *PoisonBatchError) {
+			poisoned = append(poisoned, err)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	const logs = 64
+	for i := 0; i < logs; i++ {
+		l.Send([]byte(fmt.Sprintf("log%d", i)))
+	}
+	res := l.DrainWithResult()
+	if res.SentLogs != 0 || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	// the batch twice, then at most 4 requests per bisection level and the parts left at the limit
+	if n := atomic.LoadInt32(&requests); n > 2+4*7+7 {
+		t.Fatalf("%d requests for a batch of %d logs", n, logs)
+	}
+	dropped := 0
+	for _, p := range poisoned {
+		dropped += strings.Count(string(p.Logs), "\n")
+	}
+	if dropped != logs || len(poisoned) != res.FailedBatches {
+		t.Fatalf("%d logs in %d poison batches, %d failed batches", dropped, len(poisoned), res.FailedBatches)
+	}
+	if m := l.Metrics(); m.DroppedLogs != logs || m.QueuedLogs != 0 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+// SetDrainProgressCallback to be called as the batches of a drain are delivered, with the bytes sent
+// by the drain so far and the bytes left. The remaining bytes include the queue only for the in-memory
+// queue, for the disk queue they are the logs the drain already dequeued. The callback runs on another
+// goroutine than the drain so it may call the sender, a slow callback gets the latest progress only
+func SetDrainProgressCallback(callback func(sentBytes, remainingBytes uint64)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.progressFunc = callback
+		return nil
+	}
+}
+
+type drainProgress struct {
+	sent, remaining uint64
+}
+
+// progressReporter passes the progress of a drain to the callback goroutine, keeping the latest
+// progress when the callback is behind. A nil reporter ignores the progress
+type progressReporter struct {
+	updates chan drainProgress
+}
+
+func newProgressReporter(callback func(sentBytes, remainingBytes uint64)) *progressReporter {
+	if callback == nil {
+		return nil
+	}
+	p := &progressReporter{updates: make(chan drainProgress, 1)}
+	go func() {
+		for u := range p.updates {
+			callback(u.sent, u.remaining)
+		}
+	}()
+	return p
+}
+
+func (p *progressReporter) report(sent, remaining uint64) {
+	if p == nil {
+		return
+	}
+	for {
+		select {
+		case p.updates <- drainProgress{sent: sent, remaining: remaining}:
+			return
+		default:
+		}
+		// replace the progress the callback didn't get yet
+		select {
+		case <-p.updates:
+		default:
+		}
+	}
+}
+
+// close ends the callback goroutine once it got the last progress, without waiting for it
+func (p *progressReporter) close() {
+	if p == nil {
+		return
+	}
+	close(p.updates)
+}
+
+// remainingBytes returns the bytes of batches and, for the in-memory queue, of the queued logs
+func (l *LogzioSender) remainingBytes(batches []batch) uint64 {
+	var remaining uint64
+	for _, b := range batches {
+		remaining += uint64(len(b.data))
+	}
+	if l.inMemoryQueue {
+		remaining += l.queue.Length()
+		if !l.noNewline {
+			// the drain appends a newline to each log
+			remaining += l.queueCount()
+		}
+	}
+	return remaining
+}
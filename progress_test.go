@@ -0,0 +1,84 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_DrainProgressCallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	var (
+		mux      sync.Mutex
+		progress []drainProgress
+	)
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetMaxBatchCount(2),
+		SetDrainDuration(time.Hour),
+		SetDrainProgressCallback(func(sentBytes, remainingBytes uint64) {
+			mux.Lock()
+			defer mux.Unlock()
+			progress = append(progress, drainProgress{sent: sentBytes, remaining: remainingBytes})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	log := bytes.Repeat([]byte("a"), 99)
+	for i := 0; i < 20; i++ {
+		l.Send(log)
+	}
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	// the callback runs on its own goroutine
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		mux.Lock()
+		done := len(progress) > 0 && progress[len(progress)-1].remaining == 0
+		mux.Unlock()
+		if done {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected the progress of the whole drain")
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(progress) < 2 {
+		t.Fatalf("Expected several progress callbacks, got %v", progress)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i].remaining >= progress[i-1].remaining || progress[i].sent+progress[i].remaining != 2000 {
+			t.Fatalf("Unexpected progress %v", progress)
+		}
+	}
+	if last := progress[len(progress)-1]; last.sent != 2000 {
+		t.Fatalf("Unexpected sent bytes %d at the end of the drain", last.sent)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beeker1121/goque"
+)
+
+// queueFormatVersion of the disk queue items, written to the version file of the queue directory
+const queueFormatVersion = 1
+
+const queueVersionFile = "logzio-queue-version"
+
+// migratingSuffix of the directory holding the old queue during a migration
+const migratingSuffix = ".migrating"
+
+// IncompatibleQueuePolicy what New does with a disk queue written with another queue format version
+type IncompatibleQueuePolicy int
+
+const (
+	// FailIncompatibleQueue returns an *IncompatibleQueueError from New, the default
+	FailIncompatibleQueue IncompatibleQueuePolicy = iota
+	// DiscardIncompatibleQueue deletes the queue and its logs and starts an empty queue
+	DiscardIncompatibleQueue
+	// MigrateIncompatibleQueue reads each item of the queue and writes it to a new queue in the current
+	// format. New fails when the queue can't be read
+	MigrateIncompatibleQueue
+)
+
+// IncompatibleQueueError is returned by New for a disk queue written with another queue format version
+type IncompatibleQueueError struct {
+	Dir     string
+	Version string // content of the version file
+}
+
+func (e *IncompatibleQueueError) Error() string {
+	return fmt.Sprintf("logzio: the queue at %s has format version %q, expected %d", e.Dir, e.Version, queueFormatVersion)
+}
+
+// SetOnIncompatibleQueue to choose what New does with a disk queue written with another queue format version.
+// A queue without a version file, written before the version file was added, has the current format
+func SetOnIncompatibleQueue(policy IncompatibleQueuePolicy) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if policy < FailIncompatibleQueue || policy > MigrateIncompatibleQueue {
+			return fmt.Errorf("invalid incompatible queue policy %d", policy)
+		}
+		l.incompatible = policy
+		return nil
+	}
+}
+
+// openDiskQueue opens the disk queue in dir after checking its format version
+func (l *LogzioSender) openDiskQueue(dir string) (*diskQueue, error) {
+	if err := l.recoverMigration(dir); err != nil {
+		return nil, fmt.Errorf("failed to recover the interrupted migration of the queue at %s: %v", dir, err)
+	}
+	versionPath := filepath.Join(dir, queueVersionFile)
+	content, err := ioutil.ReadFile(versionPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	version := strings.TrimSpace(string(content))
+	if err == nil && version != strconv.Itoa(queueFormatVersion) {
+		incompatible := &IncompatibleQueueError{Dir: dir, Version: version}
+		switch l.incompatible {
+		case DiscardIncompatibleQueue:
+			l.warnLog("logziosender.go: %s, discarding the queue\n", incompatible)
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+		case MigrateIncompatibleQueue:
+			l.warnLog("logziosender.go: %s, migrating the queue\n", incompatible)
+			if err := migrateQueue(dir); err != nil {
+				return nil, fmt.Errorf("%s, migration failed: %v", incompatible, err)
+			}
+		default:
+			return nil, incompatible
+		}
+	}
+	q, err := goque.OpenQueue(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(versionPath, []byte(strconv.Itoa(queueFormatVersion)+"\n"), 0644); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return newDiskQueue(q), nil
+}
+
+// migrateQueue moves the items of the queue in dir to a new queue in dir, decoding each of them
+// the way the drain does so they are written back uncompressed in the current format.
+// The old queue is only read, on an error it is moved back to dir with all its items
+func migrateQueue(dir string) error {
+	old := dir + migratingSuffix
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := copyToNewQueue(old, dir); err != nil {
+		os.RemoveAll(dir)
+		if rerr := os.Rename(old, dir); rerr != nil {
+			return fmt.Errorf("%v, the old queue stays at %s: %v", err, old, rerr)
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// copyToNewQueue copies the items of the queue in old to a new queue in dir, then writes the version
+// file that marks the migration as complete
+func copyToNewQueue(old, dir string) error {
+	from, err := goque.OpenQueue(old)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, err := goque.OpenQueue(dir)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	for offset := uint64(0); offset < from.Length(); offset++ {
+		item, err := from.PeekByOffset(offset)
+		if err != nil {
+			return err
+		}
+		logs, requeues, requeued := itemLogs(item.Value)
+		if requeued {
+			logs = withRequeues(logs, requeues)
+		}
+		if _, err := to.Enqueue(logs); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, queueVersionFile), []byte(strconv.Itoa(queueFormatVersion)+"\n"), 0644)
+}
+
+// recoverMigration finishes a migration of the queue in dir interrupted by a crash. The new queue is
+// kept once it has its version file, otherwise the old queue, left whole by the migration, is moved back
+func (l *LogzioSender) recoverMigration(dir string) error {
+	old := dir + migratingSuffix
+	_, err := os.Stat(old)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, queueVersionFile))
+	if err == nil && strings.TrimSpace(string(content)) == strconv.Itoa(queueFormatVersion) {
+		l.warnLog("logziosender.go: Removing the old queue at %s left by an interrupted migration\n", old)
+		return os.RemoveAll(old)
+	}
+	l.warnLog("logziosender.go: Restoring the queue at %s left by an interrupted migration\n", old)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(old, dir)
+}
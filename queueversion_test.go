@@ -0,0 +1,172 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beeker1121/goque"
+)
+
+// queueWithVersion returns the dir of a disk queue holding two logs, with version in its version file
+func queueWithVersion(t *testing.T, version string) string {
+	dir := fmt.Sprintf("%s/logzio-version-%d", os.TempDir(), time.Now().UnixNano())
+	l := newVersionedSender(t, dir)
+	if err := l.Send([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Send([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	l.queue.Close()
+	versionPath := filepath.Join(dir, queueVersionFile)
+	if version == "" {
+		if err := os.Remove(versionPath); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := ioutil.WriteFile(versionPath, []byte(version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newVersionedSender(t *testing.T, dir string, options ...SenderOptionFunc) *LogzioSender {
+	l, err := New("fake-token", append([]SenderOptionFunc{
+		SetUrl("http://localhost:12345"),
+		SetTempDirectory(dir),
+		SetCheckDiskSpace(false),
+		SetDrainDuration(time.Hour),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLogzioSender_QueueVersion(t *testing.T) {
+	// a queue without a version file predates it and has the current format
+	dir := queueWithVersion(t, "")
+	defer os.RemoveAll(dir)
+	l := newVersionedSender(t, dir)
+	defer l.queue.Close()
+	if count := l.QueueCount(); count != 2 {
+		t.Fatalf("Unexpected %d logs in the queue without a version file", count)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, queueVersionFile))
+	if err != nil || string(content) != "1\n" {
+		t.Fatalf("Unexpected version file %q %v", content, err)
+	}
+}
+
+func TestLogzioSender_IncompatibleQueue(t *testing.T) {
+	dir := queueWithVersion(t, "2")
+	defer os.RemoveAll(dir)
+	_, err := New("fake-token", SetTempDirectory(dir), SetCheckDiskSpace(false))
+	if e, ok := err.(*IncompatibleQueueError); !ok || e.Version != "2" || e.Dir != dir {
+		t.Fatalf("Expected an IncompatibleQueueError, got %v", err)
+	}
+
+	l := newVersionedSender(t, dir, SetOnIncompatibleQueue(DiscardIncompatibleQueue))
+	if count := l.QueueCount(); count != 0 {
+		t.Fatalf("Unexpected %d logs in the discarded queue", count)
+	}
+	l.queue.Close()
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetOnIncompatibleQueue(IncompatibleQueuePolicy(3))); err == nil {
+		t.Fatal("Expected an error for an invalid incompatible queue policy")
+	}
+}
+
+func TestLogzioSender_MigrateIncompatibleQueue(t *testing.T) {
+	dir := queueWithVersion(t, "0")
+	defer os.RemoveAll(dir)
+	l := newVersionedSender(t, dir, SetOnIncompatibleQueue(MigrateIncompatibleQueue))
+	defer l.queue.Close()
+	logs := l.PeekQueue(3)
+	if len(logs) != 2 || string(logs[0]) != "first" || string(logs[1]) != "second" {
+		t.Fatalf("Unexpected logs %q after the migration", logs)
+	}
+	if _, err := os.Stat(dir + migratingSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected the migrated queue to be removed, got %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, queueVersionFile))
+	if err != nil || string(content) != "1\n" {
+		t.Fatalf("Unexpected version file %q %v", content, err)
+	}
+}
+
+func TestLogzioSender_MigrateIncompatibleQueueFailure(t *testing.T) {
+	dir := queueWithVersion(t, "0")
+	defer os.RemoveAll(dir)
+	// the lock of the open queue keeps the migration from opening it
+	locked, err := goque.OpenQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New("fake-token", SetTempDirectory(dir), SetCheckDiskSpace(false), SetOnIncompatibleQueue(MigrateIncompatibleQueue)); err == nil {
+		t.Fatal("Expected an error migrating a locked queue")
+	}
+	locked.Close()
+	if _, err := os.Stat(dir + migratingSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old queue to be moved back, got %v", err)
+	}
+	l := newVersionedSender(t, dir, SetOnIncompatibleQueue(MigrateIncompatibleQueue))
+	defer l.queue.Close()
+	if logs := l.PeekQueue(3); len(logs) != 2 {
+		t.Fatalf("Unexpected logs %q after the failed migration", logs)
+	}
+}
+
+func TestLogzioSender_InterruptedMigration(t *testing.T) {
+	// interrupted while copying, the new queue has no version file yet
+	dir := queueWithVersion(t, "0")
+	defer os.RemoveAll(dir)
+	if err := os.Rename(dir, dir+migratingSuffix); err != nil {
+		t.Fatal(err)
+	}
+	partial, err := goque.OpenQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.Enqueue([]byte("first"))
+	partial.Close()
+	l := newVersionedSender(t, dir, SetOnIncompatibleQueue(MigrateIncompatibleQueue))
+	logs := l.PeekQueue(3)
+	if len(logs) != 2 || string(logs[0]) != "first" || string(logs[1]) != "second" {
+		t.Fatalf("Unexpected logs %q after restoring the old queue", logs)
+	}
+	l.queue.Close()
+	if _, err := os.Stat(dir + migratingSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old queue to be removed, got %v", err)
+	}
+
+	// interrupted while removing the old queue, the new queue is complete
+	if err := os.Mkdir(dir+migratingSuffix, 0755); err != nil {
+		t.Fatal(err)
+	}
+	l = newVersionedSender(t, dir)
+	defer l.queue.Close()
+	if logs := l.PeekQueue(3); len(logs) != 2 {
+		t.Fatalf("Unexpected logs %q after removing the old queue", logs)
+	}
+	if _, err := os.Stat(dir + migratingSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old queue to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var errReconfigureNeedsNewSender = errors.New("only the runtime options can be reconfigured, create a new sender")
+
+// runtimeConfig holds the fields of the options Reconfigure can change, named like the sender fields
+type runtimeConfig struct {
+	url              string
+	queryParams      url.Values
+	drainDuration    time.Duration
+	maxDrainTime     time.Duration
+	debug            io.Writer
+	debugLevel       DebugLevel
+	retryPolicy      RetryPolicy
+	compress         bool
+	contentType      string
+	httpMethod       string
+	requestDecorator func(req *http.Request)
+	interceptor      func(req *http.Request) error
+	respInterceptor  func(resp *http.Response) error
+	isSuccess        func(statusCode int) bool
+	maxRequeues      int
+	diskThreshold    float32
+}
+
+// fixedConfig holds the fields of the options that only apply when the sender is created, Reconfigure
+// validates the options against them and logs like the sender
+type fixedConfig struct {
+	dir              string
+	inMemoryQueue    bool
+	diskCompress     bool
+	fallbackToMemory bool
+	bufferPool       *sync.Pool
+	proxyURL         *url.URL
+	proxyAuth        *url.Userinfo
+	sharedTransport  bool
+	unixSocket       string
+	minTLSVersion    uint16
+	connectTimeout   time.Duration
+	name             string
+	structuredDebug  bool
+}
+
+// Reconfigure applies opts to the running sender as a whole, once the drain in progress is done.
+// The options are applied to a copy of the runtime config first and none of them is applied when one fails.
+// These options can be changed at runtime: SetUrl, SetQueryParam, SetDrainDuration (from the next
+// drain timer tick), SetMaxDrainDuration, SetDebug, SetDebugLevel, SetRetryPolicy, SetCompress,
+// SetContentType, SetHTTPMethod, SetRequestDecorator, SetRequestInterceptor, SetResponseInterceptor,
+// SetSuccessStatus, SetMaxRequeues and SetDrainDiskThreshold.
+// Any other option changing the sender, e.g. the queue options, the transport options,
+// SetMaxConcurrentSends or SetWriteBuffer, needs a new sender and is rejected
+func (l *LogzioSender) Reconfigure(opts ...SenderOptionFunc) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.queueSwap.RLock()
+	fixed := l.fixedConfig()
+	l.queueSwap.RUnlock()
+	// the options only run on the probe, the sender takes its runtime config
+	probe := newSender(l.token)
+	probe.setFixedConfig(fixed)
+	probe.setRuntimeConfig(l.runtimeConfig())
+	before := snapshot(probe)
+	for _, opt := range opts {
+		if err := opt(probe); err != nil {
+			return err
+		}
+	}
+	if !onlyRuntimeChanged(before, probe) {
+		return errReconfigureNeedsNewSender
+	}
+
+	l.configMux.Lock()
+	l.setRuntimeConfig(probe.runtimeConfig())
+	l.configMux.Unlock()
+	l.infoLog("logziosender.go: Reconfigured with %d options\n", len(opts))
+	return nil
+}
+
+func (l *LogzioSender) fixedConfig() fixedConfig {
+	return fixedConfig{
+		dir:              l.dir,
+		inMemoryQueue:    l.inMemoryQueue,
+		diskCompress:     l.diskCompress,
+		fallbackToMemory: l.fallbackToMemory,
+		bufferPool:       l.bufferPool,
+		proxyURL:         l.proxyURL,
+		proxyAuth:        l.proxyAuth,
+		sharedTransport:  l.sharedTransport,
+		unixSocket:       l.unixSocket,
+		minTLSVersion:    l.minTLSVersion,
+		connectTimeout:   l.connectTimeout,
+		name:             l.name,
+		structuredDebug:  l.structuredDebug,
+	}
+}
+
+func (l *LogzioSender) setFixedConfig(c fixedConfig) {
+	l.dir = c.dir
+	l.inMemoryQueue = c.inMemoryQueue
+	l.diskCompress = c.diskCompress
+	l.fallbackToMemory = c.fallbackToMemory
+	l.bufferPool = c.bufferPool
+	l.proxyURL = c.proxyURL
+	l.proxyAuth = c.proxyAuth
+	l.sharedTransport = c.sharedTransport
+	l.unixSocket = c.unixSocket
+	l.minTLSVersion = c.minTLSVersion
+	l.connectTimeout = c.connectTimeout
+	l.name = c.name
+	l.structuredDebug = c.structuredDebug
+}
+
+func (l *LogzioSender) runtimeConfig() runtimeConfig {
+	params := url.Values{}
+	for key, values := range l.queryParams {
+		params[key] = append([]string(nil), values...)
+	}
+	return runtimeConfig{
+		url:              l.url.Load(),
+		queryParams:      params,
+		drainDuration:    l.drainDuration,
+		maxDrainTime:     l.maxDrainTime,
+		debug:            l.debug,
+		debugLevel:       l.debugLevel,
+		retryPolicy:      l.retryPolicy,
+		compress:         l.compress,
+		contentType:      l.contentType,
+		httpMethod:       l.httpMethod,
+		requestDecorator: l.requestDecorator,
+		interceptor:      l.interceptor,
+		respInterceptor:  l.respInterceptor,
+		isSuccess:        l.isSuccess,
+		maxRequeues:      l.maxRequeues,
+		diskThreshold:    l.diskThreshold,
+	}
+}
+
+func (l *LogzioSender) setRuntimeConfig(c runtimeConfig) {
+	l.url.Store(c.url)
+	l.queryParams = c.queryParams
+	l.drainDuration = c.drainDuration
+	l.maxDrainTime = c.maxDrainTime
+	l.debug = c.debug
+	l.debugLevel = c.debugLevel
+	l.retryPolicy = c.retryPolicy
+	l.compress = c.compress
+	l.contentType = c.contentType
+	l.httpMethod = c.httpMethod
+	l.requestDecorator = c.requestDecorator
+	l.interceptor = c.interceptor
+	l.respInterceptor = c.respInterceptor
+	l.isSuccess = c.isSuccess
+	l.maxRequeues = c.maxRequeues
+	l.diskThreshold = c.diskThreshold
+}
+
+// runtimeFields are the names of the sender fields in runtimeConfig
+var runtimeFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(runtimeConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Name] = true
+	}
+	return fields
+}()
+
+// snapshot copies the fields of the unused sender l, its locks are not held
+func snapshot(l *LogzioSender) *LogzioSender {
+	c := reflect.New(reflect.TypeOf(l).Elem())
+	c.Elem().Set(reflect.ValueOf(l).Elem())
+	return c.Interface().(*LogzioSender)
+}
+
+// onlyRuntimeChanged reports whether the senders only differ in the fields of runtimeConfig,
+// maps, pointers, channels and functions are compared by reference
+func onlyRuntimeChanged(before, after *LogzioSender) bool {
+	b, a := reflect.ValueOf(before).Elem(), reflect.ValueOf(after).Elem()
+	for i := 0; i < b.NumField(); i++ {
+		if !runtimeFields[b.Type().Field(i).Name] && !sameValue(b.Field(i), a.Field(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Chan, reflect.Func, reflect.Map, reflect.Ptr, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Slice:
+		return a.Pointer() == b.Pointer() && a.Len() == b.Len()
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && sameValue(a.Elem(), b.Elem())
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if !sameValue(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !sameValue(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+	}
+	return true
+}
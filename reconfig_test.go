@@ -0,0 +1,205 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_Reconfigure(t *testing.T) {
+	var first, second int64
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&first, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" || r.URL.Query().Get("env") != "prod" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt64(&second, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts2.Close()
+	l, err := New("fake-token", SetUrl(ts1.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if err := l.Reconfigure(SetUrl(ts2.URL), SetQueryParam("env", "prod"), SetCompress(true), SetDrainDuration(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&first) != 0 || atomic.LoadInt64(&second) != 1 {
+		t.Fatalf("Unexpected requests %d to the old url and %d to the new one", first, second)
+	}
+	if d := l.nextDrainDuration(); d != time.Minute {
+		t.Fatalf("Unexpected drain duration %v", d)
+	}
+}
+
+func TestLogzioSender_ReconfigureRollback(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	url := l.url.Load()
+
+	// an invalid option fails the validation before any option is applied
+	if err := l.Reconfigure(SetUrl("http://localhost:23456"), SetDrainDuration(0)); err == nil {
+		t.Fatal("Expected an error for an invalid drain duration")
+	}
+	if got := l.url.Load(); got != url {
+		t.Fatalf("Unexpected url %s after a failed reconfiguration", got)
+	}
+
+	// a failing option discards the options before it
+	fail := func(l *LogzioSender) error {
+		return errors.New("failed")
+	}
+	if err := l.Reconfigure(SetUrl("http://localhost:23456"), SetCompress(true), SetQueryParam("env", "prod"), fail); err == nil {
+		t.Fatal("Expected the error of the last option")
+	}
+	if got := l.url.Load(); got != url || l.compress || len(l.queryParams) != 0 {
+		t.Fatalf("Unexpected config after a failed reconfiguration, url %s compress %t params %v", got, l.compress, l.queryParams)
+	}
+
+	// an option keeping the queue type is accepted
+	if err := l.Reconfigure(SetInMemoryQueue(true)); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []SenderOptionFunc{SetInMemoryQueue(false), SetTempDirectory("/tmp/other"), SetProxy("http://proxy:3128"), SetUnixSocket("/tmp/agent.sock")} {
+		if err := l.Reconfigure(option); err != errReconfigureNeedsNewSender {
+			t.Fatalf("Expected an error for an option that needs a new sender, got %v", err)
+		}
+	}
+}
+
+func TestLogzioSender_ReconfigureOnlyRuntimeOptions(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetInMemoryQueue(true), SetDrainDuration(time.Hour),
+		SetMaxConcurrentSends(2), SetWriteBuffer(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	// every runtime option is accepted
+	err = l.Reconfigure(SetUrl("http://localhost:23456"), SetQueryParam("env", "prod"), SetDrainDuration(time.Minute),
+		SetMaxDrainDuration(time.Second), SetDebug(nil), SetDebugLevel(DebugLevelWarn), SetRetryPolicy(noRetryPolicy{}),
+		SetCompress(true), SetContentType("text/plain"), SetHTTPMethod(http.MethodPut),
+		SetRequestDecorator(func(req *http.Request) {}),
+		SetRequestInterceptor(func(req *http.Request) error { return nil }),
+		SetResponseInterceptor(func(resp *http.Response) error { return nil }),
+		SetSuccessStatus(func(statusCode int) bool { return statusCode == http.StatusOK }),
+		SetMaxRequeues(3), SetDrainDiskThreshold(90))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the send slots and the write buffer in use are kept
+	slots, buffer := l.sendSlots, l.writeBuffer
+	l.Send([]byte("buffered"))
+	for _, option := range []SenderOptionFunc{SetMaxConcurrentSends(4), SetWriteBuffer(2048)} {
+		if err := l.Reconfigure(option); err != errReconfigureNeedsNewSender {
+			t.Fatalf("Expected an error for an option that needs a new sender, got %v", err)
+		}
+	}
+	// an option leaving the runtime config as it is doesn't change the sender
+	if err := l.Reconfigure(SetWriteBuffer(0)); err != nil {
+		t.Fatal(err)
+	}
+	if l.sendSlots != slots || cap(l.sendSlots) != 2 || l.writeBuffer != buffer {
+		t.Fatal("Unexpected send slots or write buffer after a rejected reconfiguration")
+	}
+	l.flushWriteBuffer()
+	if count := l.QueueCount(); count != 1 {
+		t.Fatalf("Expected the buffered log to be queued, got %d", count)
+	}
+}
+
+func TestLogzioSender_ReconfigureWhileSending(t *testing.T) {
+	l, err := New("fake-token", SetUrl("http://localhost:12345"), SetDrainDuration(time.Hour),
+		SetDebug(ioutil.Discard), SetRetryPolicy(noRetryPolicy{}), setCheckDiskDuration(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(l.dir)
+	defer l.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			l.Send([]byte("blah"))
+		}
+	}()
+	// the debug logs of Send and the disk check read what Reconfigure writes
+	for i := 0; i < 50; i++ {
+		level := DebugLevelDebug
+		if i%2 == 0 {
+			level = DebugLevelWarn
+		}
+		if err := l.Reconfigure(SetDebug(ioutil.Discard), SetDebugLevel(level), SetDrainDiskThreshold(90+i%10)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	<-done
+}
+
+func TestLogzioSender_ReconfigureWhilePinging(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := l.Ping(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// Ping reads the method, content type and request hooks that Reconfigure writes
+	for i := 0; i < 50; i++ {
+		method, contentType := http.MethodPost, "application/json"
+		if i%2 == 0 {
+			method, contentType = http.MethodPut, "application/x-ndjson"
+		}
+		if err := l.Reconfigure(SetHTTPMethod(method), SetContentType(contentType),
+			SetRequestDecorator(func(req *http.Request) {})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,93 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Status codes passed to a RetryPolicy when no HTTP response was received
+const (
+	StatusTransportError = httpError // transient transport error such as a timeout or a refused connection
+	StatusDNSError       = dnsError  // the listener host could not be resolved
+	StatusTLSError       = tlsError  // the TLS handshake or the certificate verification failed
+)
+
+// RetryPolicy decides whether a request is retried and how long to wait before retrying.
+// attempt is 0 for the first request of a batch. When the policy stops retrying a failed
+// request, the batch is requeued unless the listener rejected it with 400 or 401
+type RetryPolicy interface {
+	ShouldRetry(statusCode int, attempt int) (retry bool, wait time.Duration)
+}
+
+// DefaultRetryPolicy sends up to 4 requests with an exponential backoff starting at 2 seconds.
+// Successful requests, 400, 401, DNS and TLS errors are not retried
+type DefaultRetryPolicy struct{}
+
+// ShouldRetry implements RetryPolicy
+func (DefaultRetryPolicy) ShouldRetry(statusCode int, attempt int) (bool, time.Duration) {
+	switch statusCode {
+	case http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized:
+		return false, 0
+	case dnsError, tlsError:
+		// won't be fixed by retrying right away
+		return false, 0
+	}
+	if attempt >= sendRetries-1 {
+		return false, 0
+	}
+	return true, sendSleepingBackoff << uint(attempt)
+}
+
+// SetRetryPolicy to replace the DefaultRetryPolicy
+func SetRetryPolicy(policy RetryPolicy) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.retryPolicy = policy
+		return nil
+	}
+}
+
+// SetRetryOn404 false to stop retrying requests answered with 404 whatever the retry policy,
+// the batch is requeued for the next drain. The default true leaves it to the retry policy,
+// the DefaultRetryPolicy retries 404 like other server errors
+func SetRetryOn404(retry bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.noRetryOn404 = !retry
+		return nil
+	}
+}
+
+// SetSuccessStatus to decide which listener status codes mean the batch was delivered, the default is any 2xx.
+// A delivered batch is neither retried nor requeued, the RetryPolicy is given 200 for it
+func SetSuccessStatus(success func(statusCode int) bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if success == nil {
+			return errors.New("invalid nil success status function")
+		}
+		l.isSuccess = success
+		return nil
+	}
+}
+
+func isSuccess2xx(statusCode int) bool {
+	return statusCode >= 200 && statusCode <= 299
+}
+
+// isRejected reports whether the listener rejected the batch, such a batch is dropped rather than requeued
+func isRejected(statusCode int) bool {
+	return statusCode == http.StatusBadRequest || statusCode == http.StatusUnauthorized
+}
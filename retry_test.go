@@ -0,0 +1,193 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		attempt    int
+		retry      bool
+		wait       time.Duration
+	}{
+		{http.StatusOK, 0, false, 0},
+		{http.StatusBadRequest, 0, false, 0},
+		{http.StatusUnauthorized, 0, false, 0},
+		{StatusDNSError, 0, false, 0},
+		{StatusTLSError, 0, false, 0},
+		{http.StatusInternalServerError, 0, true, 2 * time.Second},
+		{StatusTransportError, 1, true, 4 * time.Second},
+		{http.StatusNotFound, 2, true, 8 * time.Second},
+		{http.StatusInternalServerError, 3, false, 0},
+	}
+	for _, c := range cases {
+		retry, wait := DefaultRetryPolicy{}.ShouldRetry(c.statusCode, c.attempt)
+		if retry != c.retry || wait != c.wait {
+			t.Errorf("status %d attempt %d: got %v %v, expected %v %v", c.statusCode, c.attempt, retry, wait, c.retry, c.wait)
+		}
+	}
+}
+
+type recordingRetryPolicy struct {
+	calls [][2]int
+}
+
+func (p *recordingRetryPolicy) ShouldRetry(statusCode int, attempt int) (bool, time.Duration) {
+	p.calls = append(p.calls, [2]int{statusCode, attempt})
+	return statusCode != http.StatusOK && attempt < 5, time.Millisecond
+}
+
+func TestLogzioSender_RetryPolicy(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			// retried by the custom policy, not by the default one
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	policy := &recordingRetryPolicy{}
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(policy),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	res := l.DrainWithResult()
+	if res.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	expected := [][2]int{{404, 0}, {404, 1}, {200, 2}}
+	if fmt.Sprint(policy.calls) != fmt.Sprint(expected) {
+		t.Fatalf("%v != %v", policy.calls, expected)
+	}
+}
+
+func TestSetRetryOn404(t *testing.T) {
+	for _, retry := range []bool{true, false} {
+		requests := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetInMemoryQueue(true),
+			SetRetryPolicy(zeroWaitRetryPolicy{}),
+			SetRetryOn404(retry),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("blah"))
+		res := l.DrainWithResult()
+		if retry && (res.SentLogs != 1 || requests != 2) {
+			t.Errorf("retry 404: unexpected result %+v after %d requests", res, requests)
+		}
+		if !retry {
+			if res.Requeued != 1 || res.StatusCode != http.StatusNotFound || requests != 1 {
+				t.Errorf("no retry on 404: unexpected result %+v after %d requests", res, requests)
+			}
+			// delivered by the next drain
+			if res := l.DrainWithResult(); res.SentLogs != 1 {
+				t.Errorf("no retry on 404: unexpected result of the next drain %+v", res)
+			}
+		}
+		l.Stop()
+		ts.Close()
+	}
+}
+
+func TestSuccessStatus(t *testing.T) {
+	for _, status := range []int{http.StatusAccepted, http.StatusNoContent} {
+		var next int32 = http.StatusServiceUnavailable
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(int(atomic.LoadInt32(&next)))
+		}))
+		l, err := New(
+			"fake-token",
+			SetUrl(ts.URL),
+			SetInMemoryQueue(true),
+			SetRetryPolicy(noRetryPolicy{}),
+			SetDrainDuration(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Send([]byte("blah"))
+		if res := l.DrainWithResult(); res.Requeued != 1 || l.Metrics().ConsecutiveFailures != 1 {
+			t.Fatalf("%d: unexpected result of the failed drain %+v", status, res)
+		}
+		atomic.StoreInt32(&next, int32(status))
+		res := l.DrainWithResult()
+		if res.SentLogs != 1 || res.Requeued != 0 || res.FailedBatches != 0 {
+			t.Errorf("%d: unexpected result %+v", status, res)
+		}
+		if m := l.Metrics(); m.ConsecutiveFailures != 0 || m.QueuedLogs != 0 || m.DroppedLogs != 0 {
+			t.Errorf("%d: unexpected metrics %+v", status, m)
+		}
+		l.Stop()
+		ts.Close()
+	}
+}
+
+func TestSetSuccessStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+		SetSuccessStatus(func(statusCode int) bool { return statusCode == http.StatusOK }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	if res := l.DrainWithResult(); res.Requeued != 1 || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetSuccessStatus(nil)); err == nil {
+		t.Fatal("Expected an error for a nil success function")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const signalFlushTimeout = 10 * time.Second
+
+// InstallSignalFlush stops the sender, draining the queue, when one of the signals is received
+// (SIGINT and SIGTERM by default). The flush is bounded by a 10 seconds timeout. The signal is
+// then forwarded to the returned channel so callers can chain their own handling, e.g. exit.
+// Only the first signal is handled, the next ones get their default handling
+func (l *LogzioSender) InstallSignalFlush(signals ...os.Signal) <-chan os.Signal {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	received := make(chan os.Signal, 1)
+	forwarded := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go l.handleSignals(received, forwarded, signalFlushTimeout)
+	return forwarded
+}
+
+func (l *LogzioSender) handleSignals(received chan os.Signal, forwarded chan<- os.Signal, timeout time.Duration) {
+	sig := <-received
+	// the next signals get their default handling
+	signal.Stop(received)
+	l.infoLog("logziosender.go: Received %v, flushing logs\n", sig)
+	done := make(chan struct{})
+	go func() {
+		l.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		l.errorLog("logziosender.go: Flush on %v did not complete in %v\n", sig, timeout)
+	}
+	forwarded <- sig
+}
@@ -0,0 +1,56 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_SignalFlush(t *testing.T) {
+	requests := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Send([]byte("blah"))
+
+	received := make(chan os.Signal, 1)
+	forwarded := make(chan os.Signal, 1)
+	go l.handleSignals(received, forwarded, time.Second)
+	received <- os.Interrupt
+
+	select {
+	case sig := <-forwarded:
+		if sig != os.Interrupt {
+			t.Fatalf("Unexpected forwarded signal %v", sig)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Signal was not forwarded")
+	}
+	select {
+	case <-requests:
+	default:
+		t.Fatal("Logs were not flushed on signal")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sink sends a batch of logs in place of the Logz.io bulk listener. It returns the HTTP status code,
+// or one of the Status*Error codes, which is passed to the RetryPolicy. The status codes SetSuccessStatus
+// accepts are a success, any 2xx by default
+type Sink interface {
+	Send(logs [][]byte) int
+}
+
+// SetSink to send the batches to sink instead of the Logz.io bulk listener
+func SetSink(sink Sink) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.sink = sink
+		return nil
+	}
+}
+
+// lines returns the logs of the batch without their newline, a requeued item holds several lines
+func (b batch) lines() [][]byte {
+	lines := make([][]byte, 0, len(b.ends))
+	for _, line := range bytes.Split(b.data, []byte{'\n'}) {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// send the batch once to the sink or to the listener, any success status is reported as 200
+func (l *LogzioSender) send(b batch) int {
+	var statusCode int
+	if l.sink == nil {
+		statusCode = l.tryToSendLogs(b.data)
+	} else {
+		start := time.Now()
+		statusCode = l.sink.Send(b.lines())
+		l.recordLatency(time.Since(start))
+	}
+	if statusCode > 0 && l.isSuccess(statusCode) {
+		return http.StatusOK
+	}
+	return statusCode
+}
+
+// OTLPSink sends logs to an OTLP/HTTP collector using the JSON encoding, each log is the body of a log record
+type OTLPSink struct {
+	endpoint string
+	client   *http.Client
+	// Header is added to every request, e.g. for authentication
+	Header http.Header
+}
+
+// NewOTLPSink creates a sink for endpoint, usually http://collector:4318/v1/logs.
+// It uses http.DefaultClient when client is nil
+func NewOTLPSink(endpoint string, client *http.Client) *OTLPSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OTLPSink{endpoint: endpoint, client: client, Header: http.Header{}}
+}
+
+type otlpLogsData struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	ObservedTimeUnixNano string       `json:"observedTimeUnixNano"`
+	Body                 otlpAnyValue `json:"body"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Send implements Sink
+func (s *OTLPSink) Send(logs [][]byte) int {
+	observed := strconv.FormatInt(time.Now().UnixNano(), 10)
+	records := make([]otlpLogRecord, 0, len(logs))
+	for _, log := range logs {
+		records = append(records, otlpLogRecord{ObservedTimeUnixNano: observed, Body: otlpAnyValue{StringValue: string(log)}})
+	}
+	body, err := json.Marshal(otlpLogsData{ResourceLogs: []otlpResourceLogs{{ScopeLogs: []otlpScopeLogs{{LogRecords: records}}}}})
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return httpError
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return classifyTransportError(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return http.StatusOK
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOTLPSink(t *testing.T) {
+	var (
+		mux    sync.Mutex
+		bodies []string
+		fail   = true
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer x" {
+			t.Errorf("Unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		var data otlpLogsData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		for _, rl := range data.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				for _, lr := range sl.LogRecords {
+					bodies = append(bodies, lr.Body.StringValue)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	sink := NewOTLPSink(ts.URL+"/v1/logs", nil)
+	sink.Header.Set("Authorization", "Bearer x")
+	l, err := New(
+		"fake-token",
+		SetUrl("http://localhost:1"),
+		SetInMemoryQueue(true),
+		SetSink(sink),
+		SetRetryPolicy(noRetryPolicy{}),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("first"))
+	l.Send([]byte(`{"second":2}`))
+
+	// the failed batch is requeued like with the bulk listener
+	if res := l.DrainWithResult(); res.Requeued != 2 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if res := l.DrainWithResult(); res.FailedBatches != 0 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(bodies) != 2 || bodies[0] != "first" || bodies[1] != `{"second":2}` {
+		t.Fatalf("Unexpected records %q", bodies)
+	}
+	if l.Stats().Requests != 2 {
+		t.Fatalf("%d requests", l.Stats().Requests)
+	}
+}
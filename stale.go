@@ -0,0 +1,111 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SetDropStaleByField to drop at drain time the JSON logs whose field, an RFC 3339 timestamp such as
+// @timestamp, is older than maxAge, e.g. to skip an old backlog after an outage. Logs without a
+// parseable timestamp are sent. The dropped logs count in the dropped logs
+func SetDropStaleByField(field string, maxAge time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if field == "" {
+			return fmt.Errorf("invalid stale log field %q", field)
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("invalid stale log max age %v", maxAge)
+		}
+		l.staleField = field
+		l.staleMaxAge = maxAge
+		return nil
+	}
+}
+
+// dropStale returns the logs of a queued item ending at ends without the stale logs, their ends and
+// the number of logs dropped. An item is a single log unless it joins several logs or was requeued,
+// the lines of a requeued item whose log ends are not known are taken as its logs
+func (l *LogzioSender) dropStale(value []byte, ends []int, requeued bool) ([]byte, []int, int) {
+	if l.staleField == "" {
+		return value, ends, 0
+	}
+	now := l.clock.Now()
+	if ends != nil {
+		var kept [][]byte
+		for _, log := range l.splitLogs(value, ends) {
+			if !l.isStale(log, now) {
+				kept = append(kept, log)
+			}
+		}
+		if len(kept) == len(ends) {
+			return value, ends, 0
+		}
+		if len(kept) == 0 {
+			return nil, nil, len(ends)
+		}
+		fresh, freshEnds := l.joinLogs(kept)
+		return fresh, freshEnds, len(ends) - len(kept)
+	}
+	if !requeued {
+		// a multi-line log is one log
+		if l.isStale(value, now) {
+			return nil, nil, 1
+		}
+		return value, nil, 0
+	}
+	value, dropped := l.dropStaleLines(value, now)
+	return value, nil, dropped
+}
+
+// dropStaleLines drops the stale lines of an item whose log ends are not known
+func (l *LogzioSender) dropStaleLines(value []byte, now time.Time) ([]byte, int) {
+	if bytes.IndexByte(value, '\n') < 0 {
+		if l.isStale(value, now) {
+			return nil, 1
+		}
+		return value, 0
+	}
+	var (
+		kept    [][]byte
+		dropped int
+	)
+	for _, line := range bytes.Split(value, []byte{'\n'}) {
+		if l.isStale(line, now) {
+			dropped++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if dropped == 0 {
+		return value, 0
+	}
+	return bytes.Join(kept, []byte{'\n'}), dropped
+}
+
+func (l *LogzioSender) isStale(log []byte, now time.Time) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(log, &fields); err != nil {
+		return false
+	}
+	var timestamp time.Time
+	if err := json.Unmarshal(fields[l.staleField], &timestamp); err != nil || timestamp.IsZero() {
+		return false
+	}
+	return now.Sub(timestamp) > l.staleMaxAge
+}
@@ -0,0 +1,106 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_DropStaleByField(t *testing.T) {
+	var body atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body.Store(string(b))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	c := newFakeClock()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.Advance(now.Sub(c.Now()))
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetDropStaleByField("@timestamp", time.Hour),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	fresh := `{"@timestamp":"2024-01-01T11:59:00Z","message":"fresh"}`
+	stale := `{"@timestamp":"2024-01-01T10:00:00+00:00","message":"stale"}`
+	for _, log := range []string{
+		fresh,
+		stale,
+		"plain text",
+		`{"message":"no timestamp"}`,
+		`{"@timestamp":"yesterday","message":"unparseable"}`,
+	} {
+		l.Send([]byte(log))
+	}
+	// an item requeued by a previous drain holds several logs, a multi-line log is one log
+	l.enqueue(withRequeues([]byte(stale+"\n"+fresh), 1))
+	l.Send([]byte(stale + "\n" + fresh))
+	if err := l.DrainSync(); err != nil {
+		t.Fatal(err)
+	}
+	expected := fresh + "\nplain text\n" + `{"message":"no timestamp"}` + "\n" +
+		`{"@timestamp":"yesterday","message":"unparseable"}` + "\n" + fresh + "\n" + stale + "\n" + fresh + "\n"
+	if got, _ := body.Load().(string); got != expected {
+		t.Fatalf("Unexpected body %q", got)
+	}
+	if dropped := l.Metrics().DroppedLogs; dropped != 2 {
+		t.Fatalf("Expected 2 stale logs dropped, got %d", dropped)
+	}
+
+	// the logs joined by the write buffer are checked one by one
+	buffered, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetDropStaleByField("@timestamp", time.Hour),
+		SetWriteBuffer(1024),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffered.Stop()
+	buffered.Send([]byte(stale))
+	buffered.Send([]byte(fresh))
+	if result := buffered.DrainWithResult(); result.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if got, _ := body.Load().(string); got != fresh+"\n" {
+		t.Fatalf("Unexpected body %q", got)
+	}
+	if dropped := buffered.Metrics().DroppedLogs; dropped != 1 {
+		t.Fatalf("Expected 1 stale log dropped, got %d", dropped)
+	}
+
+	for _, option := range []SenderOptionFunc{SetDropStaleByField("", time.Hour), SetDropStaleByField("@timestamp", 0)} {
+		if _, err := New("fake-token", SetInMemoryQueue(true), option); err == nil {
+			t.Fatal("Expected an error for an invalid stale log option")
+		}
+	}
+}
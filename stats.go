@@ -0,0 +1,204 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// weight of the latest sample in the moving averages
+const movingAverageWeight = 0.2
+
+// consecutive failed drains after which the sender is not healthy
+const unhealthyFailedDrains = 3
+
+// Stats snapshot of the sender activity
+type Stats struct {
+	Requests    uint64        // requests sent to the listener, including retries
+	LastLatency time.Duration // latency of the last request
+	MinLatency  time.Duration
+	MaxLatency  time.Duration
+	AvgLatency  time.Duration // exponential moving average of the request latency
+	// exponential moving average of the time logs wait in the queue until a drain dequeues them,
+	// logs queued by a previous run are not included
+	QueueLatency time.Duration
+	// exponential moving average of the raw bytes by the compressed bytes of the compressed requests,
+	// 0 without compression. Requests compressed by SetStreamCompression are not included
+	CompressionRatio float64
+}
+
+type senderStats struct {
+	mux                sync.Mutex
+	stats              Stats
+	queueSamples       uint64
+	compressionSamples uint64
+}
+
+// enqueueTimes of the queued items by item id
+type enqueueTimes struct {
+	mux   sync.Mutex
+	times map[uint64]time.Time
+}
+
+func (e *enqueueTimes) add(id uint64, t time.Time) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.times == nil {
+		e.times = make(map[uint64]time.Time)
+	}
+	e.times[id] = t
+}
+
+// rename moves the enqueue times to the new ids of the items after a queue migration
+func (e *enqueueTimes) rename(ids map[uint64]uint64) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	times := make(map[uint64]time.Time, len(ids))
+	for old, id := range ids {
+		if t, ok := e.times[old]; ok {
+			times[id] = t
+		}
+	}
+	e.times = times
+}
+
+// remove returns the enqueue time of a dequeued item
+func (e *enqueueTimes) remove(id uint64) (time.Time, bool) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	t, ok := e.times[id]
+	delete(e.times, id)
+	return t, ok
+}
+
+// Stats returns a snapshot of the sender activity
+func (l *LogzioSender) Stats() Stats {
+	l.stats.mux.Lock()
+	defer l.stats.mux.Unlock()
+	return l.stats.stats
+}
+
+// MetricsSnapshot of the sender state
+type MetricsSnapshot struct {
+	QueuedLogs          uint64
+	QueuedBytes         uint64        // only known for the in-memory queue
+	DroppedLogs         uint64        // logs dropped because the queue was full, too large or rejected by the listener
+	PoisonBatches       uint64        // batches dropped after the max requeues and logs rejected with a bad request
+	DedupedLogs         uint64        // duplicate logs dropped by SetDedup, not counted in DroppedLogs
+	UnreportedDrops     uint64        // logs dropped since the last batch delivered with a success status
+	LastStatusCode      int           // of the last request, see the Status*Error codes for transport errors
+	ConsecutiveFailures int           // consecutive drains that failed to send a batch
+	RetryWait           time.Duration // backoff of the retry the drain is waiting for, 0 when not waiting
+	Draining            bool
+	CircuitOpen         bool
+}
+
+// Metrics returns a snapshot of the sender state, it doesn't wait for a drain in progress
+func (l *LogzioSender) Metrics() MetricsSnapshot {
+	q, inMemory := l.currentQueue()
+	m := MetricsSnapshot{
+		QueuedLogs:          l.QueueCount(),
+		DroppedLogs:         l.droppedLogs.Load(),
+		PoisonBatches:       l.poisonBatches.Load(),
+		DedupedLogs:         l.dedupedLogs.Load(),
+		UnreportedDrops:     l.unreportedDrops.Load(),
+		LastStatusCode:      int(l.lastStatusCode.Load()),
+		ConsecutiveFailures: int(l.failedDrains.Load()),
+		RetryWait:           time.Duration(l.retryWait.Load()),
+		Draining:            l.draining.Load(),
+		CircuitOpen:         l.circuitOpen.Load(),
+	}
+	if inMemory {
+		m.QueuedBytes = q.Length()
+	}
+	return m
+}
+
+// Healthy reports whether the sender is running, its circuit is closed, the queue is not full
+// and fewer than 3 drains in a row failed. It doesn't send anything to the listener
+func (l *LogzioSender) Healthy() bool {
+	return !l.stopped.Load() && !l.circuitOpen.Load() && !l.queueFull.Load() &&
+		l.failedDrains.Load() < unhealthyFailedDrains
+}
+
+// HealthHandler responds with the Stats as JSON, with status 200 when the sender is Healthy and 503 otherwise
+func (l *LogzioSender) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(l.Stats())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if l.Healthy() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(append(body, '\n'))
+	}
+}
+
+func (l *LogzioSender) recordLatency(latency time.Duration) {
+	l.stats.mux.Lock()
+	defer l.stats.mux.Unlock()
+	s := &l.stats.stats
+	s.Requests++
+	s.LastLatency = latency
+	if s.Requests == 1 {
+		s.MinLatency, s.MaxLatency, s.AvgLatency = latency, latency, latency
+		return
+	}
+	if latency < s.MinLatency {
+		s.MinLatency = latency
+	}
+	if latency > s.MaxLatency {
+		s.MaxLatency = latency
+	}
+	s.AvgLatency = movingAverage(s.AvgLatency, latency)
+}
+
+func (l *LogzioSender) recordQueueLatency(latency time.Duration) {
+	l.stats.mux.Lock()
+	defer l.stats.mux.Unlock()
+	l.stats.queueSamples++
+	if l.stats.queueSamples == 1 {
+		l.stats.stats.QueueLatency = latency
+		return
+	}
+	l.stats.stats.QueueLatency = movingAverage(l.stats.stats.QueueLatency, latency)
+}
+
+func (l *LogzioSender) recordCompression(rawBytes, compressedBytes int) {
+	if compressedBytes == 0 {
+		return
+	}
+	ratio := float64(rawBytes) / float64(compressedBytes)
+	l.stats.mux.Lock()
+	defer l.stats.mux.Unlock()
+	l.stats.compressionSamples++
+	if l.stats.compressionSamples == 1 {
+		l.stats.stats.CompressionRatio = ratio
+		return
+	}
+	l.stats.stats.CompressionRatio = movingAverageWeight*ratio + (1-movingAverageWeight)*l.stats.stats.CompressionRatio
+}
+
+func movingAverage(avg, sample time.Duration) time.Duration {
+	return time.Duration(movingAverageWeight*float64(sample) + (1-movingAverageWeight)*float64(avg))
+}
@@ -0,0 +1,270 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_StatsLatency(t *testing.T) {
+	delay := 100 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New("fake-token", SetUrl(ts.URL), SetInMemoryQueue(true), SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if l.Stats() != (Stats{}) {
+		t.Fatalf("Unexpected stats before sending %+v", l.Stats())
+	}
+	for i := 0; i < 2; i++ {
+		l.Send([]byte("blah"))
+		l.Drain()
+	}
+	stats := l.Stats()
+	if stats.Requests != 2 {
+		t.Fatalf("Unexpected number of requests %d", stats.Requests)
+	}
+	for name, latency := range map[string]time.Duration{
+		"last": stats.LastLatency, "min": stats.MinLatency, "max": stats.MaxLatency, "avg": stats.AvgLatency,
+	} {
+		if latency < delay {
+			t.Errorf("%s latency %v lower than the server delay %v", name, latency, delay)
+		}
+	}
+	if stats.MinLatency > stats.AvgLatency || stats.AvgLatency > stats.MaxLatency {
+		t.Fatalf("Inconsistent latencies %+v", stats)
+	}
+}
+
+type slowRetryPolicy struct{}
+
+func (slowRetryPolicy) ShouldRetry(statusCode int, attempt int) (bool, time.Duration) {
+	return attempt == 0, 300 * time.Millisecond
+}
+
+func TestLogzioSender_Metrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetInMemoryCapacity(6),
+		SetRetryPolicy(slowRetryPolicy{}),
+		SetCircuitBreaker(1, time.Hour),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	// dropped, the queue is full
+	l.Send([]byte("blah"))
+
+	done := make(chan struct{})
+	go func() {
+		l.Drain()
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for m := l.Metrics(); !m.Draining || m.RetryWait != 300*time.Millisecond; m = l.Metrics() {
+		if time.Now().After(deadline) {
+			t.Fatalf("retry not visible in %+v", m)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+
+	m := l.Metrics()
+	expected := MetricsSnapshot{
+		QueuedLogs:          1,
+		QueuedBytes:         4,
+		DroppedLogs:         1,
+		UnreportedDrops:     1,
+		LastStatusCode:      http.StatusServiceUnavailable,
+		ConsecutiveFailures: 1,
+		CircuitOpen:         true,
+	}
+	if m != expected {
+		t.Fatalf("%+v != %+v", m, expected)
+	}
+}
+
+func TestLogzioSender_QueueLatency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	c := newFakeClock()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		setClock(c),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	l.Send([]byte("blah"))
+	c.Advance(time.Second)
+	l.Drain()
+	if latency := l.Stats().QueueLatency; latency != time.Second {
+		t.Fatalf("Unexpected queue latency %v", latency)
+	}
+	// draining falls behind
+	l.Send([]byte("blah"))
+	c.Advance(6 * time.Second)
+	l.Drain()
+	if latency := l.Stats().QueueLatency; latency != 2*time.Second {
+		t.Fatalf("Unexpected queue latency %v after a late drain", latency)
+	}
+}
+
+func TestLogzioSender_CompressionRatio(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetCompress(true),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	if ratio := l.Stats().CompressionRatio; ratio != 0 {
+		t.Fatalf("Unexpected compression ratio %g before sending", ratio)
+	}
+	l.Send(bytes.Repeat([]byte("a"), 10000))
+	l.Drain()
+	compressible := l.Stats().CompressionRatio
+	if compressible < 10 {
+		t.Fatalf("Unexpected compression ratio %g for compressible logs", compressible)
+	}
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	// the moving average forgets the compressible logs
+	for i := 0; i < 50; i++ {
+		l.Send(bytes.Replace(random, []byte("\n"), []byte(" "), -1))
+		l.Drain()
+	}
+	if ratio := l.Stats().CompressionRatio; ratio > 1.1 {
+		t.Fatalf("Unexpected compression ratio %g for incompressible logs, %g before", ratio, compressible)
+	}
+}
+
+func TestLogzioSender_HealthHandler(t *testing.T) {
+	var status int32 = http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+		SetRetryPolicy(noRetryPolicy{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	check := func(expected int) Stats {
+		rec := httptest.NewRecorder()
+		l.HealthHandler()(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != expected {
+			t.Fatalf("status %d, expected %d", rec.Code, expected)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Unexpected content type %s", ct)
+		}
+		var stats Stats
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	l.Send([]byte("blah"))
+	l.Drain()
+	if stats := check(http.StatusOK); stats.Requests != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	l.Send([]byte("blah"))
+	for i := 0; i < unhealthyFailedDrains; i++ {
+		l.Drain()
+	}
+	if stats := check(http.StatusServiceUnavailable); stats.Requests != 1+unhealthyFailedDrains {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if l.Healthy() {
+		t.Fatal("Healthy after failed drains")
+	}
+}
+
+func TestLogzioSender_UnreportedDropsReset(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	l, err := New(
+		"fake-token",
+		SetUrl(ts.URL),
+		SetInMemoryQueue(true),
+		SetInMemoryCapacity(8),
+		SetDrainDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	l.Send([]byte("blah"))
+	l.Send([]byte("dropped"))
+	if m := l.Metrics(); m.UnreportedDrops != 1 || m.DroppedLogs != 1 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+	if res := l.DrainWithResult(); res.SentLogs != 1 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	// a 202 delivery resets the drops since the last delivery, not the total
+	if m := l.Metrics(); m.UnreportedDrops != 0 || m.DroppedLogs != 1 {
+		t.Fatalf("Unexpected metrics after a 202 delivery %+v", m)
+	}
+}
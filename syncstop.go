@@ -0,0 +1,66 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SetSyncOnStop to fsync the files of the disk queue once Stop closed it, so the queued logs
+// survive a crash of the host right after the process exits, not only a restart of the process
+func SetSyncOnStop(sync bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.syncOnStop = sync
+		return nil
+	}
+}
+
+// syncDir fsyncs the files of dir then dir itself, for the renames and the new files
+func syncDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if err := syncFile(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// some platforms, such as windows, can't sync a directory
+	d.Sync()
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,62 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogzioSender_SyncOnStop(t *testing.T) {
+	dir := fmt.Sprintf("%s/logzio-sync-%d", os.TempDir(), time.Now().UnixNano())
+	defer os.RemoveAll(dir)
+	newSender := func() *LogzioSender {
+		l, err := New(
+			"fake-token",
+			SetUrl("http://localhost:12345"),
+			SetTempDirectory(dir),
+			SetCheckDiskSpace(false),
+			SetDrainDuration(time.Hour),
+			SetSyncOnStop(true),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// keep the logs queued on Stop
+		l.Pause()
+		return l
+	}
+	l := newSender()
+	for _, log := range []string{"one", "two", "three"} {
+		if err := l.Send([]byte(log)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Stop()
+
+	restarted := newSender()
+	defer restarted.Stop()
+	if got := exportedQueue(t, restarted); got != "one\ntwo\nthree\n" {
+		t.Fatalf("Unexpected queue after the restart %q", got)
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	if err := syncDir(os.TempDir() + "/logzio-sync-missing"); err == nil {
+		t.Fatal("Expected an error syncing a missing directory")
+	}
+}
@@ -27,12 +27,12 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	msg := fmt.Sprintf("{ \"%s\": \"%d\"}", "message", time.Now().UnixNano())
-	err = l.Send([]byte(msg))
+	msg := map[string]string{"message": fmt.Sprintf("%d", time.Now().UnixNano())}
+	err = l.SendJSON(msg)
 	if err != nil {
 		panic(err)
 	}
-	l.Send([]byte(msg))
+	err = l.SendJSON(msg)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,115 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+const defaultTruncationMarker = "...[truncated]"
+
+// SetMaxLineBytes to truncate the logs longer than n bytes to n bytes, ending with the truncation
+// marker, instead of sending lines the listener rejects. The default 0 doesn't truncate
+func SetMaxLineBytes(n int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max line bytes %d", n)
+		}
+		l.maxLineBytes = n
+		return nil
+	}
+}
+
+// SetTruncationMarker ends the logs truncated by SetMaxLineBytes, "...[truncated]" by default
+func SetTruncationMarker(marker string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.truncMarker = marker
+		return nil
+	}
+}
+
+// SetTruncateJSONField to truncate the string field of a JSON log longer than SetMaxLineBytes, e.g. its
+// message, keeping the other fields. Logs without the field or not fitting this way are truncated whole.
+// The truncated log is marshaled again with encoding/json, which sorts its fields
+func SetTruncateJSONField(field string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if field == "" {
+			return fmt.Errorf("invalid truncate field %q", field)
+		}
+		l.truncField = field
+		return nil
+	}
+}
+
+// truncate returns payload, or a new slice of at most maxLineBytes when it is longer
+func (l *LogzioSender) truncate(payload []byte) []byte {
+	if l.maxLineBytes == 0 || len(payload) <= l.maxLineBytes {
+		return payload
+	}
+	if l.truncField != "" {
+		if truncated, ok := l.truncateField(payload); ok {
+			return truncated
+		}
+	}
+	return truncateBytes(payload, l.maxLineBytes, l.truncMarker)
+}
+
+// truncateField shortens the string value of the truncate field until the log fits
+func (l *LogzioSender) truncateField(payload []byte) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, false
+	}
+	var value string
+	if err := json.Unmarshal(fields[l.truncField], &value); err != nil {
+		return nil, false
+	}
+	keep := len(value) - (len(payload) - l.maxLineBytes) - len(l.truncMarker)
+	for ; keep >= 0; keep-- {
+		truncated, err := json.Marshal(string(truncateBytes([]byte(value), keep+len(l.truncMarker), l.truncMarker)))
+		if err != nil {
+			return nil, false
+		}
+		fields[l.truncField] = truncated
+		log, err := json.Marshal(fields)
+		if err != nil {
+			return nil, false
+		}
+		if len(log) <= l.maxLineBytes {
+			return log, true
+		}
+		// escaping or the reordered fields take more bytes, shorten by the excess
+		if excess := len(log) - l.maxLineBytes; excess > 1 {
+			keep -= excess - 1
+		}
+	}
+	return nil, false
+}
+
+// truncateBytes returns a copy of b cut to n bytes including the marker, on a rune boundary
+func truncateBytes(b []byte, n int, marker string) []byte {
+	if len(marker) >= n {
+		return []byte(marker[:n])
+	}
+	cut := n - len(marker)
+	for cut > 0 && !utf8.RuneStart(b[cut]) {
+		cut--
+	}
+	truncated := make([]byte, 0, cut+len(marker))
+	truncated = append(truncated, b[:cut]...)
+	return append(truncated, marker...)
+}
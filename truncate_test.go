@@ -0,0 +1,91 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logzio
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func newTruncatingSender(t *testing.T, options ...SenderOptionFunc) *LogzioSender {
+	l, err := New("fake-token", append([]SenderOptionFunc{
+		SetUrl("http://localhost:12345"),
+		SetInMemoryQueue(true),
+		SetDrainDuration(time.Hour),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLogzioSender_MaxLineBytes(t *testing.T) {
+	l := newTruncatingSender(t, SetMaxLineBytes(20))
+	defer l.queue.Close()
+	l.Send([]byte("short log"))
+	l.Send([]byte(strings.Repeat("x", 30)))
+	l.Write([]byte(strings.Repeat("é", 15)))
+	logs := l.PeekQueue(3)
+	if string(logs[0]) != "short log" {
+		t.Fatalf("Unexpected truncation of a short log %q", logs[0])
+	}
+	if string(logs[1]) != "xxxxxx...[truncated]" {
+		t.Fatalf("Unexpected truncated log %q", logs[1])
+	}
+	// the cut doesn't split a rune
+	if len(logs[2]) > 20 || !utf8.Valid(logs[2]) || !strings.HasSuffix(string(logs[2]), "...[truncated]") {
+		t.Fatalf("Unexpected truncated log %q", logs[2])
+	}
+
+	l = newTruncatingSender(t, SetMaxLineBytes(10), SetTruncationMarker("~"))
+	defer l.queue.Close()
+	l.Send([]byte(strings.Repeat("x", 30)))
+	if logs := l.PeekQueue(1); string(logs[0]) != "xxxxxxxxx~" {
+		t.Fatalf("Unexpected truncated log %q", logs[0])
+	}
+
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetMaxLineBytes(-1)); err == nil {
+		t.Fatal("Expected an error for negative max line bytes")
+	}
+	if _, err := New("fake-token", SetInMemoryQueue(true), SetTruncateJSONField("")); err == nil {
+		t.Fatal("Expected an error for an empty truncate field")
+	}
+}
+
+func TestLogzioSender_TruncateJSONField(t *testing.T) {
+	l := newTruncatingSender(t, SetMaxLineBytes(60), SetTruncateJSONField("message"))
+	defer l.queue.Close()
+	l.Send([]byte(`{"level":"info","message":"` + strings.Repeat("m", 100) + `"}`))
+	l.Send([]byte(`{"level":"info","other":"` + strings.Repeat("o", 100) + `"}`))
+	l.Send([]byte(`{"level":"` + strings.Repeat("l", 100) + `","message":"m"}`))
+	logs := l.PeekQueue(3)
+
+	var fields map[string]string
+	if err := json.Unmarshal(logs[0], &fields); err != nil {
+		t.Fatalf("Invalid truncated JSON %q: %v", logs[0], err)
+	}
+	if len(logs[0]) > 60 || fields["level"] != "info" || !strings.HasSuffix(fields["message"], "...[truncated]") {
+		t.Fatalf("Unexpected truncated log %q", logs[0])
+	}
+	// without the field, or when the other fields don't fit, the whole log is truncated
+	for _, log := range logs[1:] {
+		if len(log) != 60 || !strings.HasSuffix(string(log), "...[truncated]") {
+			t.Fatalf("Unexpected truncated log %q", log)
+		}
+	}
+}